@@ -0,0 +1,73 @@
+package backoff
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// -------------------------------------------------------
+
+// Backoff 是带 full jitter 的指数退避：第 n 次重试前等待 [0, min(Max, Base*2^(n-1))) 内的随机时间。
+type Backoff struct {
+	Base time.Duration // 第一次重试的最大等待时间
+	Max  time.Duration // 等待时间的上限，为 0 表示不限制
+}
+
+func (b Backoff) Delay(attempt int) time.Duration {
+
+	if b.Base <= 0 || attempt <= 0 {
+		return 0
+	}
+	d := b.Base
+	for i := 1; i < attempt; i++ {
+		if b.Max > 0 && d >= b.Max {
+			break
+		}
+		if d > math.MaxInt64/2 { // 避免溢出
+			break
+		}
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// 等待第 attempt 次重试的退避时间，ctx 取消或者等待会超过 ctx 的 deadline 时立即返回错误。
+func (b Backoff) Wait(ctx context.Context, attempt int) error {
+
+	return Wait(ctx, b.Delay(attempt))
+}
+
+// -------------------------------------------------------
+
+// Wait 等待 d。ctx 取消时立即返回 ctx.Err()；等待结束会超过 ctx 的 deadline 时不等待，
+// 直接返回 context.DeadlineExceeded。
+func Wait(ctx context.Context, d time.Duration) error {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(d).After(deadline) {
+		return context.DeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// -------------------------------------------------------
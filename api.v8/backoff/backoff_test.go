@@ -0,0 +1,39 @@
+package backoff
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelay(t *testing.T) {
+	b := Backoff{Base: time.Second, Max: 5 * time.Second}
+	assert.Equal(t, time.Duration(0), b.Delay(0))
+	for i := 0; i < 100; i++ {
+		assert.True(t, b.Delay(1) < time.Second)
+		assert.True(t, b.Delay(2) < 2*time.Second)
+		assert.True(t, b.Delay(100) < 5*time.Second)
+	}
+	assert.Equal(t, time.Duration(0), Backoff{}.Delay(3))
+}
+
+func TestWait(t *testing.T) {
+	assert.NoError(t, Wait(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	assert.Equal(t, context.Canceled, Wait(ctx, time.Minute))
+	assert.True(t, time.Since(start) < time.Second)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start = time.Now()
+	assert.Equal(t, context.DeadlineExceeded, Wait(ctx, time.Minute))
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
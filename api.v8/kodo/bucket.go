@@ -36,11 +36,12 @@ func (p *Client) Bucket(name string) Bucket {
 }
 
 type Entry struct {
-	Hash     string `json:"hash"`
-	Fsize    int64  `json:"fsize"`
-	PutTime  int64  `json:"putTime"`
-	MimeType string `json:"mimeType"`
-	EndUser  string `json:"endUser"`
+	Hash     string            `json:"hash"`
+	Fsize    int64             `json:"fsize"`
+	PutTime  int64             `json:"putTime"`
+	MimeType string            `json:"mimeType"`
+	EndUser  string            `json:"endUser"`
+	XQnMeta  map[string]string `json:"x-qn-meta,omitempty"`
 }
 
 // 取文件属性。
@@ -0,0 +1,244 @@
+package kodo
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/auth/qbox"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/conf"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
+)
+
+// ----------------------------------------------------------
+
+var (
+	ErrInvalidCallbackAuth = httputil.NewError(401, "invalid callback authorization")
+	ErrUnsupportedBodyType = httputil.NewError(415, "unsupported callback body type")
+)
+
+// 上传回调请求。回调内容由上传策略的 CallbackBody 和 CallbackBodyType 决定。
+//
+type Callback struct {
+	Request *http.Request
+	Body    []byte
+	Vars    map[string]string // 以 "x:" 开头的自定义变量
+
+	form url.Values // CallbackBodyType 为 application/x-www-form-urlencoded 时的内容
+}
+
+// 把回调内容解析到 v 中。JSON 内容按 encoding/json 解析；表单内容按字段的 json tag（没有则用字段名）
+// 取对应的值，支持 string、bool、整数和浮点数字段，比如：
+//
+//	type UploadDone struct {
+//		Key   string `json:"key"`
+//		Fsize int64  `json:"fsize"`
+//		Uid   string `json:"x:uid"`
+//	}
+//
+func (p *Callback) Decode(v interface{}) error {
+
+	if p.form == nil {
+		return json.Unmarshal(p.Body, v)
+	}
+	return decodeForm(p.form, v)
+}
+
+// 处理回调请求，返回的 ret 以 JSON 格式写回，作为上传请求的返回内容。
+// 返回的错误按 httputil.DetectCode 得到的状态码写回。
+//
+type CallbackFunc func(cb *Callback) (ret interface{}, err error)
+
+type callbackHandler struct {
+	mac *qbox.Mac
+	f   CallbackFunc
+}
+
+// 返回处理上传回调的 http.Handler：校验 QBox 签名，解析表单或 JSON 回调内容后调用 f。
+// 与 Mac.VerifyCallback 不同，JSON 格式的回调内容不参与签名校验，与服务端的签名方式一致。
+// mac 为 nil 时使用全局的 ACCESS_KEY, SECRET_KEY。
+//
+func NewCallbackHandler(mac *qbox.Mac, f CallbackFunc) http.Handler {
+
+	if mac == nil {
+		mac = qbox.NewMac(conf.ACCESS_KEY, conf.SECRET_KEY)
+	}
+	return &callbackHandler{mac: mac, f: f}
+}
+
+func (p *Client) CallbackHandler(f CallbackFunc) http.Handler {
+
+	return NewCallbackHandler(p.mac, f)
+}
+
+func (h *callbackHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	cb, err := h.parse(req)
+	if err != nil {
+		httputil.Error(w, err)
+		return
+	}
+	ret, err := h.f(cb)
+	if err != nil {
+		httputil.Error(w, err)
+		return
+	}
+	if ret == nil {
+		ret = struct{}{}
+	}
+	httputil.Reply(w, 200, ret)
+}
+
+// 与服务端签名的方式一致：只有表单格式的回调内容参与签名，JSON 格式只签名 path 和 query。
+//
+func (h *callbackHandler) verify(req *http.Request, mediaType string) error {
+
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return ErrInvalidCallbackAuth
+	}
+	token, err := h.mac.SignRequest(req, mediaType == "application/x-www-form-urlencoded")
+	if err != nil {
+		return httputil.NewError(400, err.Error())
+	}
+	// 常量时间比较，避免通过响应时间猜出签名
+	if !hmac.Equal([]byte(auth), []byte("QBox "+token)) {
+		return ErrInvalidCallbackAuth
+	}
+	return nil
+}
+
+func (h *callbackHandler) parse(req *http.Request) (*Callback, error) {
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err := h.verify(req, mediaType); err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, httputil.NewError(400, err.Error())
+	}
+	cb := &Callback{Request: req, Body: body, Vars: make(map[string]string)}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		cb.form, err = url.ParseQuery(string(body))
+		if err != nil {
+			return nil, httputil.NewError(400, err.Error())
+		}
+		for k, v := range cb.form {
+			if strings.HasPrefix(k, "x:") && len(v) > 0 {
+				cb.Vars[k] = v[0]
+			}
+		}
+	case "application/json":
+		var fields map[string]interface{}
+		if err = json.Unmarshal(body, &fields); err != nil {
+			return nil, httputil.NewError(400, err.Error())
+		}
+		for k, v := range fields {
+			if s, ok := v.(string); ok && strings.HasPrefix(k, "x:") {
+				cb.Vars[k] = s
+			}
+		}
+	default:
+		return nil, ErrUnsupportedBodyType
+	}
+	return cb, nil
+}
+
+// ----------------------------------------------------------
+
+func decodeForm(form url.Values, v interface{}) error {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("decode callback: v must be a non-nil pointer")
+	}
+	rv = rv.Elem()
+	if m, ok := rv.Addr().Interface().(*map[string]string); ok {
+		if *m == nil {
+			*m = make(map[string]string)
+		}
+		for k, vals := range form {
+			if len(vals) > 0 {
+				(*m)[k] = vals[0]
+			}
+		}
+		return nil
+	}
+	if rv.Kind() != reflect.Struct {
+		return errors.New("decode callback: v must point to a struct or map[string]string")
+	}
+
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" { // 未导出的字段
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			tag = strings.Split(tag, ",")[0]
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		vals, ok := form[name]
+		if !ok || len(vals) == 0 {
+			continue
+		}
+		if err := setField(rv.Field(i), vals[0]); err != nil {
+			return errors.New("decode callback: field " + name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func setField(fv reflect.Value, s string) error {
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	default:
+		return errors.New("unsupported type " + fv.Type().String())
+	}
+	return nil
+}
+
+// ----------------------------------------------------------
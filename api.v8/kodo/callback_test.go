@@ -0,0 +1,89 @@
+package kodo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/auth/qbox"
+	"github.com/stretchr/testify/assert"
+)
+
+type uploadDone struct {
+	Key   string `json:"key"`
+	Fsize int64  `json:"fsize"`
+	Uid   string `json:"x:uid"`
+}
+
+func newCallbackRequest(t *testing.T, mac *qbox.Mac, contentType, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/callback?a=1", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	// 服务端只对表单格式的回调内容签名
+	token, err := mac.SignRequest(req, contentType == "application/x-www-form-urlencoded")
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "QBox "+token)
+	return req
+}
+
+func TestCallbackHandler(t *testing.T) {
+	mac := qbox.NewMac("ak", "sk")
+	h := NewCallbackHandler(mac, func(cb *Callback) (interface{}, error) {
+		var done uploadDone
+		if err := cb.Decode(&done); err != nil {
+			return nil, err
+		}
+		assert.Equal(t, "u1", cb.Vars["x:uid"])
+		return done, nil
+	})
+
+	for _, c := range []struct {
+		contentType string
+		body        string
+	}{
+		{"application/x-www-form-urlencoded", "key=a.txt&fsize=10&x%3Auid=u1"},
+		{"application/json", `{"key":"a.txt","fsize":10,"x:uid":"u1"}`},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newCallbackRequest(t, mac, c.contentType, c.body))
+		assert.Equal(t, 200, w.Code)
+		var ret uploadDone
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ret))
+		assert.Equal(t, uploadDone{Key: "a.txt", Fsize: 10, Uid: "u1"}, ret)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newCallbackRequest(t, qbox.NewMac("ak", "other"), "application/json", `{}`))
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestCallbackSignature(t *testing.T) {
+	mac := qbox.NewMac("ak", "sk")
+	h := NewCallbackHandler(mac, func(cb *Callback) (interface{}, error) {
+		return nil, nil
+	})
+	serve := func(contentType, body string, incbody bool) int {
+		req := httptest.NewRequest("POST", "/callback", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		token, err := mac.SignRequest(req, incbody)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "QBox "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// JSON 回调只签名 path
+	assert.Equal(t, 200, serve("application/json", `{"key":"a.txt"}`, false))
+	assert.Equal(t, 401, serve("application/json", `{"key":"a.txt"}`, true))
+	// 表单回调的内容参与签名
+	assert.Equal(t, 200, serve("application/x-www-form-urlencoded", "key=a.txt", true))
+	assert.Equal(t, 401, serve("application/x-www-form-urlencoded", "key=a.txt", false))
+
+	req := httptest.NewRequest("POST", "/callback", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
@@ -1,10 +1,12 @@
 package kodocli
 
 import (
+	"context"
 	"net/http"
 	"time"
 
 	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/conf"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/limit"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/rpc.v7"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/url.v7"
 )
@@ -43,6 +45,9 @@ type UploadConfig struct {
 	Concurrency    int
 	UseBuffer      bool
 	HostSelector   IHostSelector
+	RateLimit      *limit.RateLimit // 可选。该 Uploader 的上传带宽限制，同时还受 limit.SetGlobalRate 设置的全局带宽限制
+	RetryPolicy    RetryPolicy      // 可选。上传失败时的重试策略，默认为 DefaultRetryPolicy，可以设置为 BackoffRetryPolicy
+	WorkerPool     *WorkerPool      // 可选。分块上传（Rput）使用的任务池，默认为按 SetSettings 创建的全局任务池
 }
 
 type Uploader struct {
@@ -52,6 +57,10 @@ type Uploader struct {
 	Concurrency    int
 	UseBuffer      bool
 	HostSelector   IHostSelector
+	RateLimit      *limit.RateLimit
+	RetryPolicy    RetryPolicy
+	WorkerPool     *WorkerPool
+	UptokenSource  func(ctx context.Context) (uptoken string, err error) // 可选。分片上传（v2）中上传凭证临近过期时用于获取新的凭证
 }
 
 func NewUploader(zone int, cfg *UploadConfig) (p Uploader) {
@@ -86,6 +95,9 @@ func NewUploader(zone int, cfg *UploadConfig) (p Uploader) {
 	}
 
 	p.UseBuffer = uc.UseBuffer
+	p.RateLimit = uc.RateLimit
+	p.RetryPolicy = uc.RetryPolicy
+	p.WorkerPool = uc.WorkerPool
 	p.UpHosts = uc.UpHosts
 	p.Conn.Client = &http.Client{Transport: uc.Transport, Timeout: 10 * time.Minute}
 	return
@@ -2,8 +2,10 @@ package kodocli
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/ldcsoftware/qiniu-go-sdk/x/xlog.v7"
@@ -17,10 +19,12 @@ var (
 	ErrInvalidPutProgress = errors.New("invalid put progress")
 	ErrPutFailed          = errors.New("resumable put failed")
 	ErrUnmatchedChecksum  = errors.New("unmatched checksum")
+	ErrWorkerPoolClosed   = errors.New("worker pool closed")
 )
 
 const (
-	InvalidCtx = 701 // UP: 无效的上下文(bput)，可能情况：Ctx非法或者已经被淘汰（太久未使用）
+	InvalidCtx   = 701 // UP: 无效的上下文(bput)，可能情况：Ctx非法或者已经被淘汰（太久未使用）
+	NoSuchUpload = 612 // UP: 分片上传任务不存在，可能情况：UploadId非法、已过期或已完成
 )
 
 const (
@@ -62,23 +66,82 @@ func SetSettings(v *Settings) {
 
 // ----------------------------------------------------------
 
-var tasks chan func()
+// 分块上传的任务池。可以通过 UploadConfig.WorkerPool 或 RputExtra.WorkerPool 指定，
+// 都不指定时使用按 SetSettings 创建的全局任务池。
+//
+type WorkerPool struct {
+	tasks     chan func()
+	quit      chan struct{}
+	mutex     sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+// 创建任务池。workers 为并行 Goroutine 数目，taskQsize 为任务队列大小，为 0 表示取 workers * 4。
+//
+func NewWorkerPool(workers, taskQsize int) *WorkerPool {
 
-func worker(tasks chan func()) {
-	for {
-		task := <-tasks
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if taskQsize <= 0 {
+		taskQsize = workers * 4
+	}
+	p := &WorkerPool{
+		tasks: make(chan func(), taskQsize),
+		quit:  make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *WorkerPool) worker() {
+	for task := range p.tasks {
 		task()
 	}
 }
 
-func initWorkers() {
+// 提交任务，队列满时等待。ctx 取消或任务池已关闭时返回错误，任务不会被执行。
+//
+func (p *WorkerPool) Submit(ctx Context, task func()) error {
 
-	tasks = make(chan func(), settings.TaskQsize)
-	for i := 0; i < settings.Workers; i++ {
-		go worker(tasks)
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.closed {
+		return ErrWorkerPoolClosed
+	}
+	select {
+	case p.tasks <- task:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.quit:
+		return ErrWorkerPoolClosed
 	}
 }
 
+// 关闭任务池。之后提交的任务返回 ErrWorkerPoolClosed，已在队列中的任务执行完后 Goroutine 退出。
+//
+func (p *WorkerPool) Close() {
+
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.mutex.Lock()
+		p.closed = true
+		close(p.tasks)
+		p.mutex.Unlock()
+	})
+}
+
+var defaultPool *WorkerPool
+
+func initWorkers() {
+
+	defaultPool = NewWorkerPool(settings.Workers, settings.TaskQsize)
+}
+
 func notifyNil(blkIdx int, blkSize int, ret *BlkputRet) {}
 func notifyErrNil(blkIdx int, blkSize int, err error)   {}
 
@@ -112,6 +175,50 @@ type RputExtra struct {
 	Progresses []BlkputRet                                   // 可选。上传进度
 	Notify     func(blkIdx int, blkSize int, ret *BlkputRet) // 可选。进度提示（注意多个block是并行传输的）
 	NotifyErr  func(blkIdx int, blkSize int, err error)
+	WorkerPool *WorkerPool // 可选。执行本次上传的任务池，优先于 Uploader 的任务池
+}
+
+// 上传失败的块
+type BlockError struct {
+	BlkIdx   int
+	Offset   int64
+	Err      error // 最后一次失败的错误
+	Attempts int   // 尝试次数
+}
+
+// 分块上传有块失败时返回的错误。Progresses 即 RputExtra.Progresses，保留了成功的块的进度，
+// 调用方可以保存下来，之后用同样的 Progresses 再次上传时只会重传未完成的块。
+// 上传被 ctx 取消时 Err 为 ctx.Err()。
+//
+type RputError struct {
+	Failed     []BlockError
+	Progresses []BlkputRet
+	Err        error
+}
+
+func (e *RputError) Error() string {
+	msg := ErrPutFailed.Error()
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	if len(e.Failed) == 0 {
+		return msg
+	}
+	first := e.Failed[0]
+	return fmt.Sprintf("%s: %d blocks failed, block %d (offset %d, %d attempts): %v",
+		msg, len(e.Failed), first.BlkIdx, first.Offset, first.Attempts, first.Err)
+}
+
+// errors.Is(err, ErrPutFailed) 仍然成立，被取消时 errors.Is(err, context.Canceled) 同样成立
+func (e *RputError) Is(target error) bool {
+	return target == ErrPutFailed
+}
+
+func (e *RputError) Unwrap() error {
+	if e.Err != nil {
+		return e.Err
+	}
+	return ErrPutFailed
 }
 
 var once sync.Once
@@ -189,8 +296,6 @@ func (p Uploader) rput(
 	ctx Context, ret interface{}, uptoken string,
 	key string, hasKey bool, f io.ReaderAt, fsize int64, extra *RputExtra) error {
 
-	once.Do(initWorkers)
-
 	xl := xlog.NewWith(ctx)
 	blockCnt := BlockCount(fsize)
 
@@ -215,13 +320,33 @@ func (p Uploader) rput(
 	if extra.NotifyErr == nil {
 		extra.NotifyErr = notifyErrNil
 	}
+	pool := extra.WorkerPool
+	if pool == nil {
+		pool = p.WorkerPool
+	}
+	if pool == nil {
+		once.Do(initWorkers)
+		pool = defaultPool
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(blockCnt)
 
 	last := blockCnt - 1
 	blkSize := 1 << blockBits
-	nfails := 0
+	var failed []BlockError
+	var failedLock sync.Mutex
+	addFailed := func(blkIdx, blkSize int, err error, attempts int) {
+		extra.NotifyErr(blkIdx, blkSize, err)
+		failedLock.Lock()
+		failed = append(failed, BlockError{
+			BlkIdx:   blkIdx,
+			Offset:   int64(blkIdx) << blockBits,
+			Err:      err,
+			Attempts: attempts,
+		})
+		failedLock.Unlock()
+	}
 	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
 
 	for i := 0; i < blockCnt; i++ {
@@ -233,26 +358,40 @@ func (p Uploader) rput(
 		}
 		task := func() {
 			defer wg.Done()
+			if err := ctx.Err(); err != nil { // 已取消的上传不再执行排队中的任务
+				addFailed(blkIdx, blkSize1, err, 0)
+				return
+			}
 			tryTimes := extra.TryTimes
+			retrier := p.newRetrier(ctx, xl.ReqId, RetryPutBlock, MethodRput)
+			attempts := 0
 		lzRetry:
+			attempts++
 			err := p.resumableBput(ctx, &extra.Progresses[blkIdx], f, blkIdx, blkSize1, extra)
 			if err != nil {
 				if tryTimes > 1 {
-					tryTimes--
-					elog.Info(xl.ReqId, "resumable.Put retrying ...")
-					goto lzRetry
+					if retry, _ := retrier.next("", err); retry {
+						tryTimes--
+						goto lzRetry
+					}
 				}
 				elog.Warn(xl.ReqId, "resumable.Put", blkIdx, "failed:", err)
-				extra.NotifyErr(blkIdx, blkSize1, err)
-				nfails++
+				addFailed(blkIdx, blkSize1, err, attempts)
 			}
 		}
-		tasks <- task
+		if err := pool.Submit(ctx, task); err != nil {
+			elog.Warn(xl.ReqId, "resumable.Put", blkIdx, "submit failed:", err)
+			addFailed(blkIdx, blkSize1, err, 0)
+			wg.Done()
+		}
 	}
 
 	wg.Wait()
-	if nfails != 0 {
-		return ErrPutFailed
+	if len(failed) != 0 {
+		sort.Slice(failed, func(i, j int) bool {
+			return failed[i].BlkIdx < failed[j].BlkIdx
+		})
+		return &RputError{Failed: failed, Progresses: extra.Progresses, Err: ctx.Err()}
 	}
 
 	return p.mkfile(ctx, ret, key, hasKey, fsize, extra)
@@ -7,8 +7,11 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/limit"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/bytes.v7"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/rpc.v7"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/xlog.v7"
@@ -19,6 +22,7 @@ import (
 // ----------------------------------------------------------
 
 type uptokenTransport struct {
+	mutex     sync.RWMutex
 	token     string
 	Transport http.RoundTripper
 }
@@ -28,15 +32,30 @@ func (t *uptokenTransport) NestedObject() interface{} {
 }
 
 func (t *uptokenTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	req.Header.Set("Authorization", t.token)
+	t.mutex.RLock()
+	token := t.token
+	t.mutex.RUnlock()
+	req.Header.Set("Authorization", token)
 	return t.Transport.RoundTrip(req)
 }
 
+func (t *uptokenTransport) uptoken() string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return strings.TrimPrefix(t.token, "UpToken ")
+}
+
+func (t *uptokenTransport) setUptoken(uptoken string) {
+	t.mutex.Lock()
+	t.token = "UpToken " + uptoken
+	t.mutex.Unlock()
+}
+
 func newUptokenTransport(token string, transport http.RoundTripper) *uptokenTransport {
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
-	return &uptokenTransport{"UpToken " + token, transport}
+	return &uptokenTransport{token: "UpToken " + token, Transport: transport}
 }
 
 func newUptokenClient(token string, transport http.RoundTripper) *http.Client {
@@ -50,6 +69,7 @@ func (p Uploader) mkblk(
 	ctx Context, ret *BlkputRet, blockSize int, body io.Reader, size int) error {
 
 	url := p.chooseUpHost() + "/mkblk/" + strconv.Itoa(blockSize)
+	body = limit.NewReader(ctx, body, p.RateLimit)
 	return p.Conn.CallWith(ctx, ret, "POST", url, "application/octet-stream", body, size)
 }
 
@@ -57,6 +77,7 @@ func (p Uploader) bput(
 	ctx Context, ret *BlkputRet, body io.Reader, size int) error {
 
 	url := ret.Host + "/bput/" + ret.Ctx + "/" + strconv.FormatUint(uint64(ret.Offset), 10)
+	body = limit.NewReader(ctx, body, p.RateLimit)
 	return p.Conn.CallWith(ctx, ret, "POST", url, "application/octet-stream", body, size)
 }
 
@@ -103,6 +124,7 @@ func (p Uploader) resumableBput(
 		}
 
 		tryTimes := extra.TryTimes
+		retrier := p.newRetrier(ctx, xl.ReqId, RetryPutBlock, MethodRput)
 
 	lzRetry:
 		h.Reset()
@@ -126,9 +148,10 @@ func (p Uploader) resumableBput(
 			elog.Warn(xl.ReqId, "ResumableBlockput: bput failed -", err)
 		}
 		if tryTimes > 1 {
-			tryTimes--
-			elog.Info(xl.ReqId, "ResumableBlockput retrying ...")
-			goto lzRetry
+			if retry, _ := retrier.next("", err); retry {
+				tryTimes--
+				goto lzRetry
+			}
 		}
 		break
 	}
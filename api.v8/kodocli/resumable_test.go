@@ -0,0 +1,251 @@
+package kodocli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRputErrorIs(t *testing.T) {
+	var err error = &RputError{Failed: []BlockError{{BlkIdx: 1, Err: context.Canceled}}, Err: context.Canceled}
+	assert.True(t, errors.Is(err, ErrPutFailed))
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	var rerr *RputError
+	assert.True(t, errors.As(err, &rerr))
+	assert.Equal(t, 1, rerr.Failed[0].BlkIdx)
+
+	err = &RputError{Failed: []BlockError{{BlkIdx: 0, Err: errors.New("failed")}}}
+	assert.True(t, errors.Is(err, ErrPutFailed))
+	assert.False(t, errors.Is(err, context.Canceled))
+}
+
+func TestWorkerPoolConcurrency(t *testing.T) {
+	pool := NewWorkerPool(2, 0)
+	defer pool.Close()
+
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		err := pool.Submit(context.Background(), func() {
+			defer wg.Done()
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		})
+		assert.NoError(t, err)
+	}
+	wg.Wait()
+	assert.Equal(t, 2, maxRunning)
+}
+
+func TestWorkerPoolSubmitCanceled(t *testing.T) {
+	pool := NewWorkerPool(1, 1)
+	defer pool.Close()
+
+	// 唯一的 Goroutine 被占用，队列也已满
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan struct{})
+	assert.NoError(t, pool.Submit(context.Background(), func() {
+		close(started)
+		<-block
+	}))
+	<-started
+	assert.NoError(t, pool.Submit(context.Background(), func() {}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ran := false
+	err := pool.Submit(ctx, func() { ran = true })
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.False(t, ran)
+}
+
+func TestWorkerPoolClose(t *testing.T) {
+	pool := NewWorkerPool(1, 4)
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	executed := 0
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, pool.Submit(context.Background(), func() {
+			defer wg.Done()
+			<-block
+			executed++
+		}))
+	}
+
+	// 关闭后不能再提交，已在队列中的任务仍然执行
+	pool.Close()
+	pool.Close()
+	assert.Equal(t, ErrWorkerPoolClosed, pool.Submit(context.Background(), func() {}))
+	close(block)
+	wg.Wait()
+	assert.Equal(t, 3, executed)
+}
+
+func TestRputQueuedTasksCanceled(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		w.WriteHeader(503)
+	}))
+	defer srv.Close()
+
+	pool := NewWorkerPool(1, 4)
+	defer pool.Close()
+	block := make(chan struct{})
+	started := make(chan struct{})
+	assert.NoError(t, pool.Submit(context.Background(), func() {
+		close(started)
+		<-block
+	}))
+	<-started
+
+	// 任务排队期间上传被取消，轮到执行时不再发送请求
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewUploader(0, &UploadConfig{UpHosts: []string{srv.URL}})
+	done := make(chan error, 1)
+	go func() {
+		data := make([]byte, 2<<blockBits)
+		done <- p.Rput(ctx, nil, "uptoken", "key", bytes.NewReader(data), int64(len(data)), &RputExtra{WorkerPool: pool})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	close(block)
+
+	err := <-done
+	var rerr *RputError
+	if assert.True(t, errors.As(err, &rerr)) {
+		assert.Len(t, rerr.Failed, 2)
+		for _, f := range rerr.Failed {
+			assert.Equal(t, context.Canceled, f.Err)
+			assert.Equal(t, 0, f.Attempts)
+		}
+	}
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, 0, requests)
+}
+
+// rputServer 模拟分块上传（v1）的 mkblk/bput/mkfile 接口。每块的内容都是块号，
+// fail 中的块的请求都返回 503
+type rputServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	fail    map[int]bool
+	mkblks  map[int]int // 每块 mkblk 的请求次数
+	mkfiles int
+}
+
+func newRputServer() *rputServer {
+	s := &rputServer{fail: map[int]bool{}, mkblks: map[int]int{}}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *rputServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	segs := strings.Split(req.URL.Path, "/")
+	switch segs[1] {
+	case "mkblk", "bput":
+		var blkIdx, offset int
+		if segs[1] == "mkblk" {
+			blkIdx = int(body[0])
+			s.mkblks[blkIdx]++
+		} else { // /bput/<ctx>/<offset>
+			blkIdx, _ = strconv.Atoi(strings.TrimPrefix(segs[2], "ctx-"))
+			offset, _ = strconv.Atoi(segs[3])
+		}
+		if s.fail[blkIdx] {
+			w.WriteHeader(503)
+			return
+		}
+		json.NewEncoder(w).Encode(BlkputRet{
+			Ctx:    fmt.Sprint("ctx-", blkIdx),
+			Crc32:  crc32.ChecksumIEEE(body),
+			Offset: uint32(offset + len(body)),
+			Host:   s.URL,
+		})
+	case "mkfile":
+		s.mkfiles++
+		w.Write([]byte(`{"hash":"h","key":"key"}`))
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+func TestRputFailedBlock(t *testing.T) {
+	s := newRputServer()
+	defer s.Close()
+	s.fail[1] = true
+
+	// 3 块，最后一块不满
+	data := make([]byte, 2<<blockBits+100)
+	for i := range data {
+		data[i] = byte(i >> blockBits)
+	}
+	p := NewUploader(0, &UploadConfig{UpHosts: []string{s.URL}})
+	pool := NewWorkerPool(2, 0)
+	defer pool.Close()
+	extra := &RputExtra{TryTimes: 3, ChunkSize: 1 << 20, WorkerPool: pool}
+	err := p.Rput(context.Background(), nil, "uptoken", "key", bytes.NewReader(data), int64(len(data)), extra)
+
+	assert.True(t, errors.Is(err, ErrPutFailed))
+	assert.False(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, ErrPutFailed, errors.Unwrap(err))
+	var rerr *RputError
+	if assert.True(t, errors.As(err, &rerr)) && assert.Len(t, rerr.Failed, 1) {
+		f := rerr.Failed[0]
+		assert.Equal(t, 1, f.BlkIdx)
+		assert.Equal(t, int64(1<<blockBits), f.Offset)
+		assert.Equal(t, 3, f.Attempts)
+		assert.Equal(t, 503, httputil.DetectCode(f.Err))
+
+		// 成功的块保留了进度
+		assert.Len(t, rerr.Progresses, 3)
+		assert.Equal(t, uint32(1<<blockBits), rerr.Progresses[0].Offset)
+		assert.Equal(t, "", rerr.Progresses[1].Ctx)
+		assert.Equal(t, uint32(100), rerr.Progresses[2].Offset)
+	}
+	assert.Equal(t, 0, s.mkfiles)
+	assert.Equal(t, map[int]int{0: 1, 1: 3, 2: 1}, s.mkblks)
+
+	// 用保留的进度重新上传，只重传失败的块
+	s.fail[1] = false
+	extra.Progresses = rerr.Progresses
+	err = p.Rput(context.Background(), nil, "uptoken", "key", bytes.NewReader(data), int64(len(data)), extra)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 1, 1: 4, 2: 1}, s.mkblks)
+	assert.Equal(t, 1, s.mkfiles)
+}
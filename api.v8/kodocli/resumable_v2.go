@@ -1,32 +1,35 @@
 package kodocli
 
 import (
-	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"math/rand"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/limit"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/bytes.v7"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/xlog.v8"
 )
 
 const minUploadPartSize = 1 << 22
+const maxUploadParts = 10000
 const initPartRetryTimes = 10
 const uploadPartRetryTimes = 10
 const deletePartsRetryTimes = 5
 const completePartsRetryTimes = 20
 
 var ErrMd5NotMatch = httputil.NewError(406, "md5 not match")
+var ErrTooManyParts = errors.New("too many upload parts")
 
 //https://github.com/qbox/product/blob/master/kodo/resumable-up-v2/init_parts.md
 func (p Uploader) initParts(ctx context.Context, bucket, key, host string) (uploadId string, suggestedPartSize int64, err error) {
@@ -51,7 +54,14 @@ type UploadPartRet struct {
 func (p Uploader) uploadPart(ctx context.Context, bucket, key, host, uploadId string, partNum int, body io.Reader, bodyLen int) (ret UploadPartRet, err error) {
 	url1 := fmt.Sprintf("%s/buckets/%s/objects/%s/uploads/%s/%d", host, bucket, encode(key), uploadId, partNum)
 	h := md5.New()
-	tr := io.TeeReader(body, h)
+	var tr io.Reader = io.TeeReader(limit.NewReader(ctx, body, p.RateLimit), h)
+	if c, ok := body.(io.Closer); ok {
+		// 保留 body 的 Close，由 Transport 在不再读取 body 后调用
+		tr = struct {
+			io.Reader
+			io.Closer
+		}{tr, c}
+	}
 
 	err = p.Conn.CallWith(ctx, &ret, "PUT", url1, "application/octet-stream", tr, bodyLen)
 	if err != nil {
@@ -130,18 +140,302 @@ func (p Uploader) deleteParts(ctx context.Context, bucket, key, host, uploadId s
 	return p.Conn.Call(ctx, nil, "DELETE", url1)
 }
 
+// 上传凭证的剩余有效期不足该值时，在 initParts、completeParts 前通过 UptokenSource 更新
+const uptokenRefreshBefore = 10 * time.Minute
+
+func (p Uploader) refreshUptoken(ctx context.Context) error {
+	if p.UptokenSource == nil || p.Conn.Client == nil {
+		return nil
+	}
+	t, ok := p.Conn.Client.Transport.(*uptokenTransport)
+	if !ok {
+		return nil
+	}
+	policy, err := ParseUptoken(t.uptoken())
+	if err == nil && time.Until(time.Unix(int64(policy.Expires), 0)) > uptokenRefreshBefore {
+		return nil
+	}
+	uptoken, err := p.UptokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	t.setUptoken(uptoken)
+	return nil
+}
+
+func (p Uploader) initPartsWithRetry(ctx context.Context, bucket, key string, method UploadMethod) (uploadId string, suggestedPartSize int64, err error) {
+	if err = p.refreshUptoken(ctx); err != nil {
+		return
+	}
+	retrier := p.newRetrier(ctx, xlog.FromContextSafe(ctx).ReqId(), RetryInitParts, method)
+	for {
+		host := p.chooseUpHost()
+		uploadId, suggestedPartSize, err = p.initParts(ctx, bucket, key, host)
+		if err == nil {
+			return
+		}
+		var retry bool
+		if retry, err = retrier.next(host, err); !retry {
+			return
+		}
+	}
+}
+
+func (p Uploader) deletePartsWithRetry(ctx context.Context, bucket, key, uploadId string, method UploadMethod) error {
+	retrier := p.newRetrier(ctx, xlog.FromContextSafe(ctx).ReqId(), RetryDeleteParts, method)
+	for {
+		host := p.chooseUpHost()
+		err := p.deleteParts(ctx, bucket, key, host, uploadId)
+		if err == nil {
+			return nil
+		}
+		if retry, err := retrier.next(host, err); !retry {
+			return err
+		}
+	}
+}
+
+func (p Uploader) completePartsWithRetry(ctx context.Context, ret interface{}, bucket, key string, hasKey bool, uploadId string,
+	mp *CompleteMultipart, method UploadMethod) error {
+
+	reqId := xlog.FromContextSafe(ctx).ReqId()
+	retrier := p.newRetrier(ctx, reqId, RetryCompleteParts, method)
+	for {
+		if err := p.refreshUptoken(ctx); err != nil {
+			// 原来的凭证可能仍然有效，继续尝试
+			elog.Warn(reqId, "refresh uptoken failed:", err)
+		}
+		host := p.chooseUpHost()
+		err := p.completeParts(ctx, ret, bucket, key, host, hasKey, uploadId, mp)
+		if err == nil {
+			return nil
+		}
+		if retry, err := retrier.next(host, err); !retry {
+			return err
+		}
+	}
+}
+
+type PartInfo struct {
+	PartNumber int    `json:"partNumber"`
+	Etag       string `json:"etag"`
+	Size       int64  `json:"size"`
+	PutTime    int64  `json:"putTime"`
+}
+
+type listPartsRet struct {
+	UploadId         string     `json:"uploadId"`
+	ExpireAt         int64      `json:"expireAt"`
+	PartNumberMarker int        `json:"partNumberMarker"`
+	Parts            []PartInfo `json:"parts"`
+}
+
+const listPartsLimit = 1000
+
+//https://github.com/qbox/product/blob/master/kodo/resumable-up-v2/list_parts.md
+func (p Uploader) listParts(ctx context.Context, bucket, key, host, uploadId string, partNumberMarker int) (ret listPartsRet, err error) {
+	url1 := fmt.Sprintf("%s/buckets/%s/objects/%s/uploads/%s?max-parts=%d", host, bucket, encode(key), uploadId, listPartsLimit)
+	if partNumberMarker > 0 {
+		url1 += fmt.Sprintf("&part-number-marker=%d", partNumberMarker)
+	}
+	err = p.Conn.Call(ctx, &ret, "GET", url1)
+	return
+}
+
+// 列举分片上传任务中服务端已经收到的分片，按 PartNumber 升序返回。
+//
+// ctx      是请求的上下文。
+// uptoken  是由业务服务器颁发的上传凭证。
+// bucket   是分片上传任务所在的空间。
+// key      是要上传的文件访问路径。
+// uploadId 是 initParts 返回的分片上传任务 ID。
+//
+func (p Uploader) ListParts(ctx context.Context, uptoken, bucket, key, uploadId string) (parts []PartInfo, err error) {
+	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
+	return p.listAllParts(ctx, bucket, key, uploadId)
+}
+
+func (p Uploader) listAllParts(ctx context.Context, bucket, key, uploadId string) (parts []PartInfo, err error) {
+	marker := 0
+	for {
+		host := p.chooseUpHost()
+		ret, err := p.listParts(ctx, bucket, key, host, uploadId, marker)
+		if err != nil {
+			p.setFailed(host, err)
+			return nil, err
+		}
+		parts = append(parts, ret.Parts...)
+		if ret.PartNumberMarker <= marker || len(ret.Parts) == 0 {
+			break
+		}
+		marker = ret.PartNumberMarker
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+// 未完成的分片上传任务
+type UploadInfo struct {
+	Key      string `json:"key"`
+	UploadId string `json:"uploadId"`
+	InitTime int64  `json:"initTime"` // 任务创建时间，单位秒
+	ExpireAt int64  `json:"expireAt"` // 任务过期时间，单位秒
+}
+
+type listUploadsRet struct {
+	Uploads []UploadInfo `json:"uploads"`
+	Marker  string       `json:"marker"`
+}
+
+const listUploadsLimit = 1000
+
+func (p Uploader) listUploads(ctx context.Context, bucket, host, prefix, marker string) (ret listUploadsRet, err error) {
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(listUploadsLimit))
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if marker != "" {
+		q.Set("marker", marker)
+	}
+	url1 := fmt.Sprintf("%s/buckets/%s/uploads?%s", host, bucket, q.Encode())
+	err = p.Conn.Call(ctx, &ret, "GET", url1)
+	return
+}
+
+// 列举空间中 key 以 prefix 开头的未完成的分片上传任务。uptoken 需要有该空间的上传权限。
+//
+func (p Uploader) ListUploads(ctx context.Context, uptoken, bucket, prefix string) (uploads []UploadInfo, err error) {
+	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
+	marker := ""
+	for {
+		host := p.chooseUpHost()
+		ret, err := p.listUploads(ctx, bucket, host, prefix, marker)
+		if err != nil {
+			p.setFailed(host, err)
+			return nil, err
+		}
+		uploads = append(uploads, ret.Uploads...)
+		if ret.Marker == "" || len(ret.Uploads) == 0 {
+			break
+		}
+		marker = ret.Marker
+	}
+	return uploads, nil
+}
+
+// 放弃分片上传任务，删除已上传的分片。
+//
+func (p Uploader) AbortUpload(ctx context.Context, uptoken, bucket, key, uploadId string) error {
+	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
+	return p.deletePartsWithRetry(ctx, bucket, key, uploadId, MethodReaderAt)
+}
+
+// 分片上传（v2）的断点续传信息。
+type UploadProgress struct {
+	UploadId      string                                     // 可选。已有的分片上传任务，为空则新建
+	Parts         []Part                                     // 可选。已上传的分片，下标为 partNum-1，Etag 为空表示该分片尚未上传
+	OnInit        func(uploadId string, uploadParts []int64) // 可选。新建分片上传任务后回调，便于调用方持久化进度
+	DeleteOnError bool                                       // 可选。上传失败时删除已上传的分片，而不是保留以便继续上传
+}
+
 func (p Uploader) Upload(ctx context.Context, ret interface{}, uptoken string, key string, f io.ReaderAt, fsize int64,
 	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
-	uploadParts := p.makeUploadParts(fsize)
-	return p.upload(ctx, ret, uptoken, key, true, f, fsize, uploadParts, mp, partNotify)
+	return p.upload(ctx, ret, uptoken, key, true, f, fsize, nil, mp, nil, partNotify)
 }
 
 func (p Uploader) UploadWithParts(ctx context.Context, ret interface{}, uptoken string, key string, f io.ReaderAt, fsize int64, uploadParts []int64,
 	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
-	if !p.checkUploadParts(fsize, uploadParts) {
-		return errors.New("part size not equal with fsize")
+	if err := p.checkUploadParts(fsize, uploadParts); err != nil {
+		return err
+	}
+	return p.upload(ctx, ret, uptoken, key, true, f, fsize, uploadParts, mp, nil, partNotify)
+}
+
+// 分片上传一个文件，支持从 progress 记录的进度继续上传。
+// uploadParts 为 nil 时，新建的任务参考服务端建议的分片大小切分，继续已有任务时按 UploadPartSize 切分。
+// 上传失败时默认不会删除已上传的分片，由调用方决定继续上传还是放弃。
+func (p Uploader) UploadWithProgress(ctx context.Context, ret interface{}, uptoken string, key string, f io.ReaderAt, fsize int64, uploadParts []int64,
+	mp *CompleteMultipart, progress *UploadProgress, partNotify func(partIdx int, etag string)) error {
+	if uploadParts != nil {
+		if err := p.checkUploadParts(fsize, uploadParts); err != nil {
+			return err
+		}
+	}
+	if progress == nil {
+		progress = new(UploadProgress)
+	}
+	return p.upload(ctx, ret, uptoken, key, true, f, fsize, uploadParts, mp, progress, partNotify)
+}
+
+// 继续一个已有的分片上传任务。
+// 先通过 ListParts 取得服务端已有的分片，与本地数据比对大小和 etag，只重新上传缺失或者不一致的分片，最后合成文件。
+// uploadParts 为 nil 时按服务端已有分片中最大的分片大小切分，即最初上传时的分片大小；服务端没有分片时按 UploadPartSize 切分。
+//
+func (p Uploader) UploadResume(ctx context.Context, ret interface{}, uptoken string, key string, uploadId string, f io.ReaderAt, fsize int64,
+	uploadParts []int64, mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
+
+	xl := xlog.FromContextSafe(ctx)
+	if fsize == 0 {
+		return errors.New("can't upload empty file")
+	}
+	if uploadParts != nil {
+		if err := p.checkUploadParts(fsize, uploadParts); err != nil {
+			return err
+		}
+	}
+
+	policy, err := ParseUptoken(uptoken)
+	if err != nil {
+		return err
+	}
+	bucket := strings.Split(policy.Scope, ":")[0]
+
+	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
+	remoteParts, err := p.listAllParts(ctx, bucket, key, uploadId)
+	if err != nil {
+		return err
+	}
+	if uploadParts == nil {
+		var partSize int64
+		for _, rp := range remoteParts {
+			if rp.Size > partSize {
+				partSize = rp.Size
+			}
+		}
+		if partSize > 0 && partNumber(fsize, partSize) <= maxUploadParts {
+			uploadParts = splitUploadParts(fsize, partSize)
+		} else {
+			uploadParts = p.makeUploadParts(fsize)
+		}
+	}
+
+	progress := &UploadProgress{UploadId: uploadId, Parts: make([]Part, len(uploadParts))}
+	offsets := make([]int64, len(uploadParts))
+	for i := 1; i < len(uploadParts); i++ {
+		offsets[i] = offsets[i-1] + uploadParts[i-1]
+	}
+	reused := 0
+	for _, rp := range remoteParts {
+		idx := rp.PartNumber - 1
+		if idx < 0 || idx >= len(uploadParts) || rp.Size != uploadParts[idx] {
+			continue
+		}
+		etag, err := qetag.Etag(io.NewSectionReader(f, offsets[idx], uploadParts[idx]))
+		if err != nil {
+			return err
+		}
+		if etag != rp.Etag {
+			elog.Warn(xl.ReqId(), "uploadResume: part mismatch", rp.PartNumber, rp.Etag, etag)
+			continue
+		}
+		progress.Parts[idx] = Part{rp.PartNumber, rp.Etag}
+		reused++
 	}
-	return p.upload(ctx, ret, uptoken, key, true, f, fsize, uploadParts, mp, partNotify)
+	elog.Info(xl.ReqId(), "uploadResume:", uploadId, "reuse parts", reused, "of", len(uploadParts))
+	return p.upload(ctx, ret, uptoken, key, true, f, fsize, uploadParts, mp, progress, partNotify)
 }
 
 func (p Uploader) UploadWithDataChan(ctx context.Context, ret interface{}, uptoken string, key string, dataCh chan PartData,
@@ -151,20 +445,19 @@ func (p Uploader) UploadWithDataChan(ctx context.Context, ret interface{}, uptok
 
 func (p Uploader) UploadWithoutKey(ctx context.Context, ret interface{}, uptoken string, f io.ReaderAt, fsize int64,
 	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
-	uploadParts := p.makeUploadParts(fsize)
-	return p.upload(ctx, ret, uptoken, "", false, f, fsize, uploadParts, mp, partNotify)
+	return p.upload(ctx, ret, uptoken, "", false, f, fsize, nil, mp, nil, partNotify)
 }
 
 func (p Uploader) UploadWithoutKeyWithParts(ctx context.Context, ret interface{}, uptoken string, f io.ReaderAt, fsize int64, uploadParts []int64,
 	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
-	if !p.checkUploadParts(fsize, uploadParts) {
-		return errors.New("part size not equal with fsize")
+	if err := p.checkUploadParts(fsize, uploadParts); err != nil {
+		return err
 	}
-	return p.upload(ctx, ret, uptoken, "", false, f, fsize, uploadParts, mp, partNotify)
+	return p.upload(ctx, ret, uptoken, "", false, f, fsize, uploadParts, mp, nil, partNotify)
 }
 
 func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key string, hasKey bool, f io.ReaderAt, fsize int64, uploadParts []int64,
-	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
+	mp *CompleteMultipart, progress *UploadProgress, partNotify func(partIdx int, etag string)) error {
 
 	xl := xlog.FromContextSafe(ctx)
 	if fsize == 0 {
@@ -178,9 +471,32 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 	bucket := strings.Split(policy.Scope, ":")[0]
 
 	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
-	uploadId, _, err := p.initParts(ctx, bucket, key, p.chooseUpHost())
-	if err != nil {
-		return err
+	var uploadId string
+	if progress != nil && progress.UploadId != "" {
+		uploadId = progress.UploadId
+		elog.Info(xl.ReqId(), "resume upload:", uploadId)
+		if uploadParts == nil {
+			uploadParts = p.makeUploadParts(fsize)
+		}
+		if progress.Parts != nil && len(progress.Parts) != len(uploadParts) {
+			return ErrInvalidPutProgress
+		}
+	} else {
+		var suggestedPartSize int64
+		uploadId, suggestedPartSize, err = p.initPartsWithRetry(ctx, bucket, key, MethodReaderAt)
+		if err != nil {
+			return err
+		}
+		if uploadParts == nil {
+			uploadParts = p.planUploadParts(fsize, suggestedPartSize)
+		}
+		if progress != nil {
+			progress.UploadId = uploadId
+			progress.Parts = nil
+			if progress.OnInit != nil {
+				progress.OnInit(uploadId, uploadParts)
+			}
+		}
 	}
 
 	var partUpErr error
@@ -194,11 +510,15 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 	var wg sync.WaitGroup
 	var lastPartEnd int64 = 0
 	for i := 0; i < partCnt; i++ {
-		wg.Add(1)
-		bkLimit.Acquire(nil)
 		partSize := uploadParts[i]
 		offset := lastPartEnd
 		lastPartEnd = partSize + offset
+		if progress != nil && progress.Parts != nil && progress.Parts[i].Etag != "" {
+			parts[i] = Part{i + 1, progress.Parts[i].Etag}
+			continue
+		}
+		wg.Add(1)
+		bkLimit.Acquire(nil)
 		go func(f io.ReaderAt, offset int64, partNum int, partSize int64) {
 			defer func() {
 				bkLimit.Release(nil)
@@ -210,12 +530,16 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 			default:
 			}
 			xl := xlog.NewWith(xlog.FromContextSafe(ctx).ReqId() + "." + fmt.Sprint(partNum))
-			tryTimes := uploadPartRetryTimes
+			retrier := p.newRetrier(partUpCtx, xl.ReqId(), RetryUploadPart, MethodReaderAt)
 		lzRetry:
 			var r io.Reader = io.NewSectionReader(f, offset, partSize)
+			var body *bytes.PoolReader
 			if p.UseBuffer {
-				buf, err := ioutil.ReadAll(r)
+				buf, err := readPart(partUpCtx, r, partSize)
 				if err != nil {
+					if err == context.Canceled {
+						return
+					}
 					partUpErrLock.Lock()
 					partUpErr = err
 					partUpErrLock.Unlock()
@@ -223,24 +547,24 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 					cancel()
 					return
 				}
-				r = bytes.NewReader(buf)
+				body = bytes.DefaultPool.NewReader(buf)
+				r = body
+			}
+			host := p.chooseUpHost()
+			ret, err := p.uploadPart(partUpCtx, bucket, key, host, uploadId, partNum, r, int(partSize))
+			if body != nil {
+				// 通常 Transport 已经关闭了 body，请求没有发出时在这里归还缓冲
+				body.Close()
 			}
-			ret, err := p.uploadPart(partUpCtx, bucket, key, p.chooseUpHost(), uploadId, partNum, r, int(partSize))
 			if err != nil {
 				if err == context.Canceled {
 					return
 				}
-
-				code := httputil.DetectCode(err)
-				if code == 509 { // 因为流量受限失败，不减少重试次数
-					elog.Warn(xl.ReqId(), "uploadPartRetryLater:", partNum, err)
-					time.Sleep(time.Second * time.Duration(rand.Intn(9)+1))
-					goto lzRetry
-				} else if tryTimes > 1 && (code == 406 || code/100 != 4) {
-					tryTimes--
-					elog.Warn(xl.ReqId(), "uploadPartRetry:", partNum, err)
-					time.Sleep(time.Second * 3)
+				retry, err1 := retrier.next(host, err)
+				if retry {
 					goto lzRetry
+				} else if err1 == context.Canceled {
+					return
 				}
 
 				partUpErrLock.Lock()
@@ -260,16 +584,10 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 	wg.Wait()
 
 	if partUpErr != nil {
-		for i := 0; i < deletePartsRetryTimes; i++ {
-			err = p.deleteParts(ctx, bucket, key, p.chooseUpHost(), uploadId)
-			code := httputil.DetectCode(err)
-			if err == nil || code/100 == 4 {
-				break
-			} else {
-				elog.Error(xl.ReqId(), "deleteParts:", err)
-				time.Sleep(time.Second * 3)
-			}
+		if progress != nil && !progress.DeleteOnError { // 保留已上传的分片，以便后续继续上传
+			return partUpErr
 		}
+		err = p.deletePartsWithRetry(ctx, bucket, key, uploadId, MethodReaderAt)
 		if err != nil {
 			return err
 		}
@@ -281,28 +599,12 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 	}
 	mp.Parts = parts
 
-	for i := 0; i < completePartsRetryTimes; i++ {
-		err = p.completeParts(ctx, ret, bucket, key, p.chooseUpHost(), hasKey, uploadId, mp)
-		code := httputil.DetectCode(err)
-		if err == nil || code/100 == 4 || code == 612 || code == 614 || code == 579 {
-			if code == 612 || code == 614 {
-				elog.Warn(xl.ReqId(), "completeParts:", err)
-				err = nil
-			}
-			break
-		} else {
-			elog.Error(xl.ReqId(), "completeParts:", err, code)
-			time.Sleep(time.Second * 3)
-		}
-	}
-	return err
+	return p.completePartsWithRetry(ctx, ret, bucket, key, hasKey, uploadId, mp, MethodReaderAt)
 }
 
 func (p Uploader) uploadWithDataChan(ctx context.Context, ret interface{}, uptoken, key string, hasKey bool, dataCh chan PartData,
 	mp *CompleteMultipart, initNotify func(suggestedPartSize int64), partNotify func(partIdx int, etag string)) error {
 
-	xl := xlog.FromContextSafe(ctx)
-
 	policy, err := ParseUptoken(uptoken)
 	if err != nil {
 		return err
@@ -310,20 +612,7 @@ func (p Uploader) uploadWithDataChan(ctx context.Context, ret interface{}, uptok
 	bucket := strings.Split(policy.Scope, ":")[0]
 
 	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
-	var uploadId string
-	var suggestedPartSize int64
-	for i := 0; i < initPartRetryTimes; i++ {
-		host := p.chooseUpHost()
-		uploadId, suggestedPartSize, err = p.initParts(ctx, bucket, key, host)
-		code := httputil.DetectCode(err)
-		if err == nil || code/100 == 4 {
-			break
-		} else {
-			elog.Error(xl.ReqId(), "initParts:", err)
-			p.setFailed(host, err)
-			time.Sleep(time.Second)
-		}
-	}
+	uploadId, suggestedPartSize, err := p.initPartsWithRetry(ctx, bucket, key, MethodDataChan)
 	if err != nil {
 		return err
 	}
@@ -366,7 +655,7 @@ func (p Uploader) uploadWithDataChan(ctx context.Context, ret interface{}, uptok
 				wg.Done()
 			}()
 			xl := xlog.NewWith(xlog.FromContextSafe(ctx).ReqId() + "." + fmt.Sprint(partNum))
-			tryTimes := uploadPartRetryTimes
+			retrier := p.newRetrier(partUpCtx, xl.ReqId(), RetryUploadPart, MethodDataChan)
 		lzRetry:
 			var r io.Reader = io.NewSectionReader(part.Data, 0, int64(part.Size))
 			host := p.chooseUpHost()
@@ -375,18 +664,11 @@ func (p Uploader) uploadWithDataChan(ctx context.Context, ret interface{}, uptok
 				if err == context.Canceled {
 					return
 				}
-
-				p.setFailed(host, err)
-				code := httputil.DetectCode(err)
-				if code == 504 || code == 509 { // 因为流量受限失败，不减少重试次数
-					elog.Warn(xl.ReqId(), "uploadPartRetryLater:", partNum, err)
-					time.Sleep(time.Second * time.Duration(rand.Intn(9)+1))
-					goto lzRetry
-				} else if tryTimes > 1 && (code == 406 || code/100 != 4) {
-					tryTimes--
-					elog.Warn(xl.ReqId(), "uploadPartRetry:", partNum, err)
-					time.Sleep(time.Second)
+				retry, err1 := retrier.next(host, err)
+				if retry {
 					goto lzRetry
+				} else if err1 == context.Canceled {
+					return
 				}
 
 				partUpErrLock.Lock()
@@ -407,19 +689,13 @@ func (p Uploader) uploadWithDataChan(ctx context.Context, ret interface{}, uptok
 	}
 	wg.Wait()
 
+	if partUpErr == nil && ctx.Err() != nil { // 调用方取消了上传
+		partUpErr = ctx.Err()
+	}
 	if partUpErr != nil {
-		for i := 0; i < deletePartsRetryTimes; i++ {
-			host := p.chooseUpHost()
-			err = p.deleteParts(ctx, bucket, key, host, uploadId)
-			code := httputil.DetectCode(err)
-			if err == nil || code/100 == 4 {
-				break
-			} else {
-				elog.Error(xl.ReqId(), "deleteParts:", err)
-				p.setFailed(host, err)
-				time.Sleep(time.Second)
-			}
-		}
+		// ctx 可能已经取消，使用新的 context 删除已上传的分片
+		delCtx := xlog.NewContext(context.Background(), xlog.FromContextSafe(ctx))
+		err = p.deletePartsWithRetry(delCtx, bucket, key, uploadId, MethodDataChan)
 		if err != nil {
 			return err
 		}
@@ -435,45 +711,71 @@ func (p Uploader) uploadWithDataChan(ctx context.Context, ret interface{}, uptok
 	}
 	mp.Parts = parts
 
-	for i := 0; i < completePartsRetryTimes; i++ {
-		host := p.chooseUpHost()
-		err = p.completeParts(ctx, ret, bucket, key, host, hasKey, uploadId, mp)
-		code := httputil.DetectCode(err)
-		if err == nil || code/100 == 4 || code == 612 || code == 614 || code == 579 {
-			if code == 612 || code == 614 {
-				elog.Warn(xl.ReqId(), "completeParts:", err)
-				err = nil
-			}
-			break
-		} else {
-			elog.Error(xl.ReqId(), "completeParts:", err, code)
-			p.setFailed(host, err)
-			time.Sleep(time.Second)
-		}
+	return p.completePartsWithRetry(ctx, ret, bucket, key, hasKey, uploadId, mp, MethodDataChan)
+}
+
+// readPart 把分片读到从 bytes.DefaultPool 借用的缓冲中，用完后需要归还。
+// 作为请求的 body 时用 bytes.DefaultPool.NewReader 包装，Transport 关闭 body 时才归还
+func readPart(ctx context.Context, r io.Reader, size int64) ([]byte, error) {
+	buf, err := bytes.DefaultPool.GetContext(ctx, int(size))
+	if err != nil {
+		return nil, err
 	}
-	return err
+	if _, err = io.ReadFull(r, buf); err != nil {
+		bytes.DefaultPool.Put(buf)
+		return nil, err
+	}
+	return buf, nil
 }
 
 func (p Uploader) makeUploadParts(fsize int64) []int64 {
-	partCnt := p.partNumber(fsize)
+	return p.planUploadParts(fsize, 0)
+}
+
+// planUploadParts 切分文件：分片大小取 UploadPartSize 和服务端建议值中较大的一个，
+// 分片数超过上限时按 4M 对齐增大分片。
+func (p Uploader) planUploadParts(fsize, suggestedPartSize int64) []int64 {
+	partSize := p.UploadPartSize
+	if suggestedPartSize > partSize {
+		partSize = suggestedPartSize
+	}
+	if minPartSize := (fsize + maxUploadParts - 1) / maxUploadParts; partSize < minPartSize {
+		partSize = (minPartSize + minUploadPartSize - 1) / minUploadPartSize * minUploadPartSize
+	}
+
+	return splitUploadParts(fsize, partSize)
+}
+
+// splitUploadParts 按 partSize 切分文件，最后一个分片可能较小；fsize 为 0 时返回 nil
+func splitUploadParts(fsize, partSize int64) []int64 {
+	partCnt := partNumber(fsize, partSize)
+	if partCnt <= 0 {
+		return nil
+	}
 	uploadParts := make([]int64, partCnt)
 	for i := 0; i < partCnt-1; i++ {
-		uploadParts[i] = p.UploadPartSize
+		uploadParts[i] = partSize
 	}
-	uploadParts[partCnt-1] = fsize - (int64(partCnt)-1)*p.UploadPartSize
+	uploadParts[partCnt-1] = fsize - (int64(partCnt)-1)*partSize
 	return uploadParts
 }
 
-func (p Uploader) checkUploadParts(fsize int64, uploadParts []int64) bool {
+func (p Uploader) checkUploadParts(fsize int64, uploadParts []int64) error {
+	if len(uploadParts) > maxUploadParts {
+		return ErrTooManyParts
+	}
 	var partSize int64 = 0
 	for _, size := range uploadParts {
 		partSize += size
 	}
-	return fsize == partSize
+	if fsize != partSize {
+		return errors.New("part size not equal with fsize")
+	}
+	return nil
 }
 
-func (p Uploader) partNumber(fsize int64) int {
-	return int((fsize + p.UploadPartSize - 1) / p.UploadPartSize)
+func partNumber(fsize, partSize int64) int {
+	return int((fsize + partSize - 1) / partSize)
 }
 
 func (p Uploader) StreamUpload(ctx context.Context, ret interface{}, uptoken string, key string, f io.Reader, fsize int64,
@@ -484,8 +786,8 @@ func (p Uploader) StreamUpload(ctx context.Context, ret interface{}, uptoken str
 
 func (p Uploader) StreamUploadWithParts(ctx context.Context, ret interface{}, uptoken string, key string, f io.Reader, fsize int64, uploadParts []int64,
 	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
-	if !p.checkUploadParts(fsize, uploadParts) {
-		return errors.New("part size not equal with fsize")
+	if err := p.checkUploadParts(fsize, uploadParts); err != nil {
+		return err
 	}
 	return p.streamUpload(ctx, ret, uptoken, key, true, f, fsize, uploadParts, mp, partNotify)
 }
@@ -498,8 +800,8 @@ func (p Uploader) StreamUploadWithoutKey(ctx context.Context, ret interface{}, u
 
 func (p Uploader) StreamUploadWithoutKeyWithParts(ctx context.Context, ret interface{}, uptoken string, f io.Reader, fsize int64, uploadParts []int64,
 	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
-	if !p.checkUploadParts(fsize, uploadParts) {
-		return errors.New("part size not equal with fsize")
+	if err := p.checkUploadParts(fsize, uploadParts); err != nil {
+		return err
 	}
 	return p.streamUpload(ctx, ret, uptoken, "", false, f, fsize, uploadParts, mp, partNotify)
 }
@@ -529,7 +831,6 @@ func (s *sectionReader) Read(p []byte) (n int, err error) {
 func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, key string, hasKey bool, f io.Reader, fsize int64, uploadParts []int64,
 	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
 
-	xl := xlog.FromContextSafe(ctx)
 	if fsize == 0 {
 		return errors.New("can't upload empty file")
 	}
@@ -541,7 +842,7 @@ func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, ke
 	bucket := strings.Split(policy.Scope, ":")[0]
 
 	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
-	uploadId, _, err := p.initParts(ctx, bucket, key, p.chooseUpHost())
+	uploadId, _, err := p.initPartsWithRetry(ctx, bucket, key, MethodStream)
 	if err != nil {
 		return err
 	}
@@ -569,16 +870,7 @@ func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, ke
 	}
 
 	if partUpErr != nil {
-		for i := 0; i < deletePartsRetryTimes; i++ {
-			err = p.deleteParts(ctx, bucket, key, p.chooseUpHost(), uploadId)
-			code := httputil.DetectCode(err)
-			if err == nil || code/100 == 4 {
-				break
-			} else {
-				elog.Error(xl.ReqId(), "deleteParts:", err)
-				time.Sleep(time.Second * 3)
-			}
-		}
+		err = p.deletePartsWithRetry(ctx, bucket, key, uploadId, MethodStream)
 		if err != nil {
 			return err
 		}
@@ -590,19 +882,5 @@ func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, ke
 	}
 	mp.Parts = parts
 
-	for i := 0; i < completePartsRetryTimes; i++ {
-		err = p.completeParts(ctx, ret, bucket, key, p.chooseUpHost(), hasKey, uploadId, mp)
-		code := httputil.DetectCode(err)
-		if err == nil || code/100 == 4 || code == 612 || code == 579 {
-			if code == 612 {
-				elog.Warn(xl.ReqId(), "completeParts:", err)
-				err = nil
-			}
-			break
-		} else {
-			elog.Error(xl.ReqId(), "completeParts:", err)
-			time.Sleep(time.Second * 3)
-		}
-	}
-	return err
+	return p.completePartsWithRetry(ctx, ret, bucket, key, hasKey, uploadId, mp, MethodStream)
 }
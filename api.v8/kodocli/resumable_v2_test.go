@@ -0,0 +1,212 @@
+package kodocli
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/auth/qbox"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+	xbytes "github.com/ldcsoftware/qiniu-go-sdk/x/bytes.v7"
+	"github.com/stretchr/testify/assert"
+)
+
+// partsServer 模拟分片上传（v2）的 list/upload/complete 接口
+type partsServer struct {
+	mutex     sync.Mutex
+	remote    []PartInfo // ListParts 返回的分片
+	pageSize  int        // ListParts 每页返回的分片数
+	lists     int        // ListParts 的请求次数
+	uploaded  map[int][]byte
+	completed []Part
+}
+
+func (s *partsServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	segs := strings.Split(req.URL.Path, "/") // /buckets/<bucket>/objects/<key>/uploads/<uploadId>[/<partNum>]
+	switch {
+	case req.Method == "GET":
+		s.lists++
+		marker, _ := strconv.Atoi(req.URL.Query().Get("part-number-marker"))
+		ret := listPartsRet{UploadId: segs[6]}
+		for _, part := range s.remote {
+			if part.PartNumber > marker && len(ret.Parts) < s.pageSize {
+				ret.Parts = append(ret.Parts, part)
+			}
+		}
+		if n := len(ret.Parts); n > 0 && ret.Parts[n-1].PartNumber != s.remote[len(s.remote)-1].PartNumber {
+			ret.PartNumberMarker = ret.Parts[n-1].PartNumber
+		}
+		json.NewEncoder(w).Encode(ret)
+	case req.Method == "PUT":
+		partNum, _ := strconv.Atoi(segs[7])
+		b, _ := ioutil.ReadAll(req.Body)
+		s.uploaded[partNum] = b
+		sum := md5.Sum(b)
+		json.NewEncoder(w).Encode(UploadPartRet{Etag: fmt.Sprintf("new-%d", partNum), Md5: hex.EncodeToString(sum[:])})
+	case req.Method == "POST":
+		var mp CompleteMultipart
+		json.NewDecoder(req.Body).Decode(&mp)
+		s.completed = mp.Parts
+		w.Write([]byte(`{"hash":"h","key":"k"}`))
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+func newPartsUploader(s *partsServer, partSize int64) (Uploader, string, func()) {
+	srv := httptest.NewServer(s)
+	mac := qbox.NewMac("ak", "sk")
+	uptoken := makeUptoken(mac, &PutPolicy{Scope: "bucket:key", Expires: uint32(time.Now().Unix() + 3600)})
+	p := NewUploader(0, &UploadConfig{UpHosts: []string{srv.URL}, UploadPartSize: partSize})
+	return p, uptoken, srv.Close
+}
+
+func partEtag(t *testing.T, b []byte) string {
+	etag, err := qetag.Etag(bytes.NewReader(b))
+	assert.NoError(t, err)
+	return etag
+}
+
+func TestListPartsPagination(t *testing.T) {
+	s := &partsServer{pageSize: 2, uploaded: map[int][]byte{}}
+	for i := 5; i >= 1; i-- {
+		s.remote = append([]PartInfo{{PartNumber: i, Etag: fmt.Sprint(i), Size: 1}}, s.remote...)
+	}
+	p, uptoken, done := newPartsUploader(s, 1<<20)
+	defer done()
+
+	parts, err := p.ListParts(context.Background(), uptoken, "bucket", "key", "upload")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, s.lists)
+	assert.Len(t, parts, 5)
+	for i, part := range parts {
+		assert.Equal(t, i+1, part.PartNumber)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	const partSize = 1 << 20
+	data := make([]byte, 2*partSize+partSize/2)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	s := &partsServer{pageSize: 1, uploaded: map[int][]byte{}}
+	s.remote = []PartInfo{
+		{PartNumber: 1, Etag: partEtag(t, data[:partSize]), Size: partSize}, // 一致，复用
+		{PartNumber: 2, Etag: "stale", Size: partSize},                      // etag 不一致，重传
+	}
+	// UploadPartSize 与最初上传时不同，按服务端已有分片的大小切分
+	p, uptoken, done := newPartsUploader(s, 4<<20)
+	defer done()
+
+	r := bytes.NewReader(data)
+	err := p.UploadResume(context.Background(), nil, uptoken, "key", "upload", r, int64(len(data)), nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.lists)
+
+	_, ok := s.uploaded[1]
+	assert.False(t, ok)
+	assert.Equal(t, data[partSize:2*partSize], s.uploaded[2])
+	assert.Equal(t, data[2*partSize:], s.uploaded[3])
+	assert.Equal(t, []Part{
+		{PartNumber: 1, Etag: s.remote[0].Etag},
+		{PartNumber: 2, Etag: "new-2"},
+		{PartNumber: 3, Etag: "new-3"},
+	}, s.completed)
+}
+
+func TestUploadBufferReleased(t *testing.T) {
+	const partSize = 1 << 20
+	data := make([]byte, 2*partSize+1)
+	s := &partsServer{pageSize: 1, uploaded: map[int][]byte{}}
+	p, uptoken, done := newPartsUploader(s, partSize)
+	defer done()
+	p.UseBuffer = true
+
+	inUse := xbytes.DefaultPool.InUse()
+	err := p.UploadResume(context.Background(), nil, uptoken, "key", "upload", bytes.NewReader(data), int64(len(data)), nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, s.uploaded, 3)
+	assert.Equal(t, inUse, xbytes.DefaultPool.InUse())
+}
+
+func TestUploadResumeEmpty(t *testing.T) {
+	s := &partsServer{pageSize: 1, uploaded: map[int][]byte{}}
+	p, uptoken, done := newPartsUploader(s, 1<<20)
+	defer done()
+
+	var r io.ReaderAt = strings.NewReader("")
+	err := p.UploadResume(context.Background(), nil, uptoken, "key", "upload", r, 0, nil, nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 0, s.lists)
+}
+
+func TestPlanUploadParts(t *testing.T) {
+	const mb = 1 << 20
+	cases := []struct {
+		partSize  int64 // UploadPartSize
+		suggested int64
+		fsize     int64
+		size      int64 // 期望的分片大小
+		count     int
+	}{
+		{8 * mb, 0, 20 * mb, 8 * mb, 3},
+		{8 * mb, 16 * mb, 20 * mb, 16 * mb, 2},
+		{8 * mb, 4 * mb, 20 * mb, 8 * mb, 3},
+		{8 * mb, 0, 8 * mb, 8 * mb, 1},
+		{8 * mb, 0, 1, 1, 1},
+		{4 * mb, 0, 4 * mb * maxUploadParts, 4 * mb, maxUploadParts},
+		// 超过 10000 个分片时，分片大小增大到按 4M 对齐的值
+		{4 * mb, 0, 4*mb*maxUploadParts + 1, 8 * mb, maxUploadParts/2 + 1},
+		{1 * mb, 0, 50000 * mb, 8 * mb, 6250},
+		{1 * mb, 0, 40001 * mb, 8 * mb, 5001},
+	}
+	for _, c := range cases {
+		p := Uploader{UploadPartSize: c.partSize}
+		parts := p.planUploadParts(c.fsize, c.suggested)
+		assert.Len(t, parts, c.count, c)
+		assert.True(t, len(parts) <= maxUploadParts, c)
+		assert.Equal(t, c.size, parts[0], c)
+		var sum int64
+		for i, size := range parts {
+			if i < len(parts)-1 {
+				assert.Equal(t, parts[0], size, c)
+			}
+			assert.True(t, size > 0 && size <= parts[0], c)
+			sum += size
+		}
+		assert.Equal(t, c.fsize, sum, c)
+		assert.NoError(t, p.checkUploadParts(c.fsize, parts), c)
+	}
+
+	p := Uploader{UploadPartSize: 4 * mb}
+	assert.Nil(t, p.planUploadParts(0, 0))
+}
+
+func TestCheckUploadParts(t *testing.T) {
+	p := Uploader{}
+	assert.NoError(t, p.checkUploadParts(3, []int64{1, 2}))
+	assert.Error(t, p.checkUploadParts(4, []int64{1, 2}))
+
+	parts := make([]int64, maxUploadParts+1)
+	for i := range parts {
+		parts[i] = 1
+	}
+	assert.Equal(t, ErrTooManyParts, p.checkUploadParts(int64(len(parts)), parts))
+	assert.NoError(t, p.checkUploadParts(maxUploadParts, parts[:maxUploadParts]))
+}
@@ -0,0 +1,209 @@
+package kodocli
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/backoff"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
+)
+
+// ----------------------------------------------------------
+
+// 需要重试的上传操作
+type RetryOp string
+
+const (
+	RetryFormUpload    RetryOp = "form_upload"    // 表单上传
+	RetryInitParts     RetryOp = "init_parts"     // 分片上传（v2）初始化
+	RetryUploadPart    RetryOp = "upload_part"    // 分片上传（v2）上传分片
+	RetryCompleteParts RetryOp = "complete_parts" // 分片上传（v2）合成文件
+	RetryDeleteParts   RetryOp = "delete_parts"   // 分片上传（v2）删除分片
+	RetryPutBlock      RetryOp = "put_block"      // 分块上传（v1）上传块或片
+)
+
+// 上传方式。分片上传（v2）的几种方式原有的重试行为不同，RetryPolicy 可以据此区分
+type UploadMethod int
+
+const (
+	MethodForm     UploadMethod = iota // 表单上传
+	MethodRput                         // 分块上传（v1）
+	MethodReaderAt                     // 分片上传（v2），数据来自 io.ReaderAt，比如 Upload、UploadWithProgress
+	MethodDataChan                     // 分片上传（v2），UploadWithDataChan
+	MethodStream                       // 分片上传（v2），数据来自 io.Reader，比如 StreamUpload
+)
+
+type RetryDecision struct {
+	Retry   bool          // 是否重试
+	Delay   time.Duration // 重试前等待的时间
+	Punish  bool          // 是否将本次请求的 host 标记为失败
+	Free    bool          // 本次失败不计入 attempt，比如因为流量受限失败
+	Succeed bool          // 将错误视为成功，比如合成文件时服务端返回 612/614
+}
+
+// RetryPolicy 决定上传操作失败后的处理方式。
+// attempt 是包括本次在内计入次数的失败次数，从 1 开始；code 是 httputil.DetectCode(err) 的结果。
+//
+type RetryPolicy interface {
+	Retry(op RetryOp, method UploadMethod, attempt int, err error, code int) RetryDecision
+}
+
+// 默认的重试策略。重试的操作、次数、状态码及 host 惩罚与各个上传方式原有的行为一致，
+// 等待时间为带 jitter 的指数退避：UploadWithDataChan 从 1 秒起，其他方式从 3 秒起
+//
+var DefaultRetryPolicy RetryPolicy = defaultRetryPolicy{}
+
+// 统一的重试策略：各个上传方式的同一操作行为相同，初始化失败也重试，
+// 失败时惩罚 host，按带 jitter 的指数退避等待。需要时通过 UploadConfig.RetryPolicy 设置
+//
+var BackoffRetryPolicy RetryPolicy = backoffRetryPolicy{}
+
+type defaultRetryPolicy struct{}
+
+var (
+	defaultBackoff  = backoff.Backoff{Base: 3 * time.Second, Max: 30 * time.Second}
+	dataChanBackoff = backoff.Backoff{Base: time.Second, Max: 10 * time.Second} // UploadWithDataChan
+)
+
+// 流量受限时随机等待 1~9 秒
+func throttleDelay() time.Duration {
+	return time.Second * time.Duration(rand.Intn(9)+1)
+}
+
+func (defaultRetryPolicy) Retry(op RetryOp, method UploadMethod, attempt int, err error, code int) (d RetryDecision) {
+	// UploadWithDataChan 失败后惩罚 host 并且退避的起点更短，其他方式不惩罚
+	b, punish := defaultBackoff, false
+	if method == MethodDataChan {
+		b, punish = dataChanBackoff, true
+	}
+	switch op {
+	case RetryFormUpload:
+		if code == 509 {
+			return RetryDecision{Retry: true, Delay: throttleDelay(), Free: true}
+		}
+		d.Retry = attempt < formUploadRetryTimes && (code == 406 || code/100 != 4)
+	case RetryInitParts:
+		if method != MethodDataChan { // 只有 UploadWithDataChan 重试初始化
+			return
+		}
+		d.Retry = attempt < initPartRetryTimes && code/100 != 4
+		d.Punish = code/100 != 4
+	case RetryUploadPart:
+		if method == MethodStream { // 流式上传的数据不能重读
+			return
+		}
+		if code == 509 || (code == 504 && method == MethodDataChan) { // 因为流量受限失败，不减少重试次数
+			return RetryDecision{Retry: true, Delay: throttleDelay(), Punish: punish, Free: true}
+		}
+		d.Retry = attempt < uploadPartRetryTimes && (code == 406 || code/100 != 4)
+		d.Punish = punish
+	case RetryCompleteParts:
+		if code == 612 || (code == 614 && method != MethodStream) {
+			return RetryDecision{Succeed: true}
+		}
+		d.Retry = attempt < completePartsRetryTimes && code/100 != 4 && code != 579
+		d.Punish = punish && code/100 != 4 && code != 579
+	case RetryDeleteParts:
+		d.Retry = attempt < deletePartsRetryTimes && code/100 != 4
+		d.Punish = punish && code/100 != 4
+	case RetryPutBlock:
+		// 次数由 RputExtra.TryTimes 限制，不等待
+		d.Retry = true
+		return
+	}
+	if d.Retry {
+		d.Delay = b.Delay(attempt)
+	}
+	return
+}
+
+type backoffRetryPolicy struct{}
+
+var (
+	retryBackoff    = backoff.Backoff{Base: time.Second, Max: 10 * time.Second}
+	throttleBackoff = backoff.Backoff{Base: 9 * time.Second, Max: 9 * time.Second} // 流量受限
+)
+
+func (backoffRetryPolicy) Retry(op RetryOp, method UploadMethod, attempt int, err error, code int) (d RetryDecision) {
+	switch op {
+	case RetryFormUpload:
+		if code == 509 {
+			return RetryDecision{Retry: true, Delay: throttleBackoff.Delay(attempt), Free: true}
+		}
+		d.Retry = attempt < formUploadRetryTimes && (code == 406 || code/100 != 4)
+	case RetryInitParts:
+		d.Retry = attempt < initPartRetryTimes && code/100 != 4
+		d.Punish = true
+	case RetryUploadPart:
+		if code == 504 || code == 509 { // 因为流量受限失败，不减少重试次数
+			return RetryDecision{Retry: true, Delay: throttleBackoff.Delay(attempt), Punish: true, Free: true}
+		}
+		d.Retry = attempt < uploadPartRetryTimes && (code == 406 || code/100 != 4)
+		d.Punish = true
+	case RetryCompleteParts:
+		if code == 612 || code == 614 {
+			return RetryDecision{Succeed: true}
+		}
+		d.Retry = attempt < completePartsRetryTimes && code/100 != 4 && code != 579
+		d.Punish = true
+	case RetryDeleteParts:
+		d.Retry = attempt < deletePartsRetryTimes && code/100 != 4
+		d.Punish = true
+	case RetryPutBlock:
+		// 次数由 RputExtra.TryTimes 限制
+		d.Retry = true
+	}
+	if d.Retry {
+		d.Delay = retryBackoff.Delay(attempt)
+	}
+	return
+}
+
+func (p Uploader) retryPolicy() RetryPolicy {
+	if p.RetryPolicy != nil {
+		return p.RetryPolicy
+	}
+	return DefaultRetryPolicy
+}
+
+// 记录某个操作的失败次数，按 RetryPolicy 等待、惩罚 host
+type retrier struct {
+	ctx     context.Context
+	p       Uploader
+	op      RetryOp
+	method  UploadMethod
+	reqId   string
+	attempt int
+}
+
+func (p Uploader) newRetrier(ctx context.Context, reqId string, op RetryOp, method UploadMethod) *retrier {
+	return &retrier{ctx: ctx, p: p, op: op, method: method, reqId: reqId}
+}
+
+// next 处理一次失败的请求，返回是否需要重试。策略将错误视为成功时返回的 err 为 nil，
+// 等待重试期间 ctx 被取消时返回 ctx 的错误。
+func (r *retrier) next(host string, err error) (bool, error) {
+	code := httputil.DetectCode(err)
+	d := r.p.retryPolicy().Retry(r.op, r.method, r.attempt+1, err, code)
+	if d.Punish && host != "" {
+		r.p.setFailed(host, err)
+	}
+	if d.Succeed {
+		elog.Warn(r.reqId, r.op, "treated as success:", err)
+		return false, nil
+	}
+	if !d.Retry {
+		return false, err
+	}
+	if !d.Free {
+		r.attempt++
+	}
+	elog.Warn(r.reqId, r.op, "retry:", err)
+	if err1 := backoff.Wait(r.ctx, d.Delay); err1 != nil {
+		return false, err1
+	}
+	return true, err
+}
+
+// ----------------------------------------------------------
@@ -0,0 +1,93 @@
+package kodocli
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	err := errors.New("failed")
+	cases := []struct {
+		op      RetryOp
+		method  UploadMethod
+		attempt int
+		code    int
+		want    RetryDecision
+		base    time.Duration // 退避的起点，不重试时为 0
+	}{
+		{RetryFormUpload, MethodForm, 1, 503, RetryDecision{Retry: true}, 3 * time.Second},
+		{RetryFormUpload, MethodForm, 1, 406, RetryDecision{Retry: true}, 3 * time.Second},
+		{RetryFormUpload, MethodForm, 1, 401, RetryDecision{}, 0},
+		{RetryFormUpload, MethodForm, 5, 503, RetryDecision{}, 0},
+
+		{RetryInitParts, MethodReaderAt, 1, 503, RetryDecision{}, 0},
+		{RetryInitParts, MethodStream, 1, 503, RetryDecision{}, 0},
+		{RetryInitParts, MethodDataChan, 1, 503, RetryDecision{Retry: true, Punish: true}, time.Second},
+		{RetryInitParts, MethodDataChan, 10, 503, RetryDecision{Punish: true}, 0},
+		{RetryInitParts, MethodDataChan, 1, 401, RetryDecision{}, 0},
+
+		{RetryUploadPart, MethodReaderAt, 1, 503, RetryDecision{Retry: true}, 3 * time.Second},
+		{RetryUploadPart, MethodReaderAt, 1, 504, RetryDecision{Retry: true}, 3 * time.Second},
+		{RetryUploadPart, MethodReaderAt, 10, 503, RetryDecision{}, 0},
+		{RetryUploadPart, MethodDataChan, 1, 503, RetryDecision{Retry: true, Punish: true}, time.Second},
+		{RetryUploadPart, MethodDataChan, 1, 401, RetryDecision{Punish: true}, 0},
+		{RetryUploadPart, MethodStream, 1, 503, RetryDecision{}, 0},
+
+		{RetryCompleteParts, MethodReaderAt, 1, 612, RetryDecision{Succeed: true}, 0},
+		{RetryCompleteParts, MethodReaderAt, 1, 614, RetryDecision{Succeed: true}, 0},
+		{RetryCompleteParts, MethodStream, 1, 612, RetryDecision{Succeed: true}, 0},
+		{RetryCompleteParts, MethodStream, 1, 614, RetryDecision{Retry: true}, 3 * time.Second},
+		{RetryCompleteParts, MethodReaderAt, 1, 579, RetryDecision{}, 0},
+		{RetryCompleteParts, MethodReaderAt, 1, 503, RetryDecision{Retry: true}, 3 * time.Second},
+		{RetryCompleteParts, MethodDataChan, 1, 503, RetryDecision{Retry: true, Punish: true}, time.Second},
+		{RetryCompleteParts, MethodDataChan, 20, 503, RetryDecision{Punish: true}, 0},
+
+		{RetryDeleteParts, MethodReaderAt, 1, 503, RetryDecision{Retry: true}, 3 * time.Second},
+		{RetryDeleteParts, MethodDataChan, 1, 503, RetryDecision{Retry: true, Punish: true}, time.Second},
+		{RetryDeleteParts, MethodStream, 5, 503, RetryDecision{}, 0},
+		{RetryDeleteParts, MethodDataChan, 1, 404, RetryDecision{}, 0},
+
+		{RetryPutBlock, MethodRput, 1, 503, RetryDecision{Retry: true}, 0},
+	}
+	for _, c := range cases {
+		got := DefaultRetryPolicy.Retry(c.op, c.method, c.attempt, err, c.code)
+		// 等待时间是 [0, base*2^(attempt-1)) 内的随机值
+		assert.True(t, got.Delay >= 0 && got.Delay <= c.base<<uint(c.attempt-1), "%v %v %d %d", c.op, c.method, c.attempt, c.code)
+		got.Delay = 0
+		assert.Equal(t, c.want, got, "%v %v %d %d", c.op, c.method, c.attempt, c.code)
+	}
+
+	// 流量受限时随机等待 1~9 秒且不计入次数
+	for _, c := range []struct {
+		op     RetryOp
+		method UploadMethod
+		code   int
+		punish bool
+	}{
+		{RetryFormUpload, MethodForm, 509, false},
+		{RetryUploadPart, MethodReaderAt, 509, false},
+		{RetryUploadPart, MethodDataChan, 509, true},
+		{RetryUploadPart, MethodDataChan, 504, true},
+	} {
+		got := DefaultRetryPolicy.Retry(c.op, c.method, 100, err, c.code)
+		assert.True(t, got.Retry && got.Free, c)
+		assert.Equal(t, c.punish, got.Punish, c)
+		assert.True(t, got.Delay >= time.Second && got.Delay <= 9*time.Second, c)
+	}
+
+	// 等待时间带 jitter，上限随失败次数翻倍，不超过 30 秒
+	delays := map[time.Duration]bool{}
+	var longest time.Duration
+	for i := 0; i < 100; i++ {
+		d := DefaultRetryPolicy.Retry(RetryCompleteParts, MethodReaderAt, 10, err, 503).Delay
+		delays[d] = true
+		if d > longest {
+			longest = d
+		}
+	}
+	assert.True(t, len(delays) > 1)
+	assert.True(t, longest > 3*time.Second && longest <= 30*time.Second, longest)
+}
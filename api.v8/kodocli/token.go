@@ -1,10 +1,20 @@
 package kodocli
 
 import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/auth/qbox"
 )
 
 type FileType uint32
@@ -47,14 +57,36 @@ type PutPolicy struct {
 	Cond    string `json:"cond,omitempty"` //格式：condKey1=condVal1&condKey2=condVal2,支持hash、mime、fsize、putTime条件，只有条件匹配才会执行覆盖操作
 }
 
+var (
+	ErrInvalidUptoken   = errors.New("invalid uptoken")
+	ErrUptokenSignature = errors.New("uptoken signature mismatch")
+	ErrUptokenExpired   = errors.New("uptoken expired")
+	ErrInvalidPolicy    = errors.New("invalid put policy")
+)
+
+// splitUptoken 把 "<AccessKey>:<Sign>:<EncodedPolicy>" 拆开。签名和策略都是 URL 安全的 base64，
+// 不包含 ':'，因此从右边拆分，AccessKey 中包含 ':' 也能正确处理。
+func splitUptoken(uptoken string) (accessKey, sign, encodedPolicy string, err error) {
+	i := strings.LastIndex(uptoken, ":")
+	if i <= 0 {
+		err = ErrInvalidUptoken
+		return
+	}
+	j := strings.LastIndex(uptoken[:i], ":")
+	if j <= 0 {
+		err = ErrInvalidUptoken
+		return
+	}
+	return uptoken[:j], uptoken[j+1 : i], uptoken[i+1:], nil
+}
+
 func ParseUptoken(uptoken string) (policy PutPolicy, err error) {
-	ps := strings.Split(uptoken, ":")
-	if len(ps) != 3 {
-		err = errors.New("invalid uptoken")
+	_, _, encodedPolicy, err := splitUptoken(uptoken)
+	if err != nil {
 		return
 	}
 
-	pb, err := base64.URLEncoding.DecodeString(ps[2])
+	pb, err := base64.URLEncoding.DecodeString(encodedPolicy)
 	if err != nil {
 		return
 	}
@@ -62,4 +94,117 @@ func ParseUptoken(uptoken string) (policy PutPolicy, err error) {
 	return
 }
 
+// 校验上传凭证是否由 mac 签发且未过期，返回其中的上传策略。
+//
+func VerifyUptoken(mac *qbox.Mac, uptoken string) (policy PutPolicy, err error) {
+	accessKey, sign, encodedPolicy, err := splitUptoken(uptoken)
+	if err != nil {
+		return
+	}
+	if accessKey != mac.AccessKey {
+		err = ErrUptokenSignature
+		return
+	}
+	h := hmac.New(sha1.New, mac.SecretKey)
+	h.Write([]byte(encodedPolicy))
+	expected := base64.URLEncoding.EncodeToString(h.Sum(nil))
+	if !hmac.Equal([]byte(sign), []byte(expected)) {
+		err = ErrUptokenSignature
+		return
+	}
+	policy, err = ParseUptoken(uptoken)
+	if err != nil {
+		return
+	}
+	if int64(policy.Expires) <= time.Now().Unix() {
+		err = ErrUptokenExpired
+	}
+	return
+}
+
+// ----------------------------------------------------------
+
+var bucketNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,63}$`)
+
+func policyError(msg string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPolicy, msg)
+}
+
+// 检查上传策略中 Scope、Cond、Checksum、MimeLimit 的格式，格式错误时 errors.Is(err, ErrInvalidPolicy) 成立。
+//
+func (p *PutPolicy) Validate() error {
+	bucket := strings.SplitN(p.Scope, ":", 2)[0]
+	if !bucketNameRegexp.MatchString(bucket) {
+		return policyError("invalid scope " + strconv.Quote(p.Scope))
+	}
+	if err := validateCond(p.Cond); err != nil {
+		return err
+	}
+	if err := validateChecksum(p.Checksum); err != nil {
+		return err
+	}
+	return validateMimeLimit(p.MimeLimit)
+}
+
+// 格式：condKey1=condVal1&condKey2=condVal2，支持 hash、mime、fsize、putTime
+func validateCond(cond string) error {
+	if cond == "" {
+		return nil
+	}
+	for _, kv := range strings.Split(cond, "&") {
+		ps := strings.SplitN(kv, "=", 2)
+		if len(ps) != 2 || ps[1] == "" {
+			return policyError("invalid cond " + strconv.Quote(kv))
+		}
+		switch ps[0] {
+		case "hash", "mime":
+		case "fsize", "putTime":
+			if _, err := strconv.ParseInt(ps[1], 10, 64); err != nil {
+				return policyError("invalid cond " + strconv.Quote(kv))
+			}
+		default:
+			return policyError("unknown cond key " + strconv.Quote(ps[0]))
+		}
+	}
+	return nil
+}
+
+// 格式：<HashName>:<HexHashValue>，目前支持 MD5/SHA1
+func validateChecksum(checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	ps := strings.SplitN(checksum, ":", 2)
+	if len(ps) != 2 {
+		return policyError("invalid checksum " + strconv.Quote(checksum))
+	}
+	var size int
+	switch strings.ToUpper(ps[0]) {
+	case "MD5":
+		size = md5.Size
+	case "SHA1":
+		size = sha1.Size
+	default:
+		return policyError("unsupported checksum hash " + strconv.Quote(ps[0]))
+	}
+	if b, err := hex.DecodeString(ps[1]); err != nil || len(b) != size {
+		return policyError("invalid checksum " + strconv.Quote(checksum))
+	}
+	return nil
+}
+
+// 格式：以 ';' 分隔的 MimeType 列表，比如 "image/*;text/plain"；以 '!' 开头表示不允许列出的类型
+func validateMimeLimit(mimeLimit string) error {
+	if mimeLimit == "" {
+		return nil
+	}
+	for _, mime := range strings.Split(strings.TrimPrefix(mimeLimit, "!"), ";") {
+		ps := strings.Split(mime, "/")
+		if len(ps) != 2 || ps[0] == "" || ps[1] == "" {
+			return policyError("invalid mimeLimit " + strconv.Quote(mimeLimit))
+		}
+	}
+	return nil
+}
+
 // ----------------------------------------------------------
@@ -0,0 +1,72 @@
+package kodocli
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/auth/qbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeUptoken(mac *qbox.Mac, policy *PutPolicy) string {
+	b, _ := json.Marshal(policy)
+	return mac.SignWithData(b)
+}
+
+func TestVerifyUptoken(t *testing.T) {
+	mac := qbox.NewMac("a:k", "sk")
+	deadline := uint32(time.Now().Unix() + 3600)
+	token := makeUptoken(mac, &PutPolicy{Scope: "bucket:key", Expires: deadline})
+
+	policy, err := ParseUptoken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "bucket:key", policy.Scope)
+
+	policy, err = VerifyUptoken(mac, token)
+	assert.NoError(t, err)
+	assert.Equal(t, deadline, policy.Expires)
+
+	_, err = VerifyUptoken(qbox.NewMac("a:k", "other"), token)
+	assert.Equal(t, ErrUptokenSignature, err)
+
+	expired := makeUptoken(mac, &PutPolicy{Scope: "bucket", Expires: uint32(time.Now().Unix() - 1)})
+	_, err = VerifyUptoken(mac, expired)
+	assert.Equal(t, ErrUptokenExpired, err)
+
+	_, err = VerifyUptoken(mac, "invalid")
+	assert.Equal(t, ErrInvalidUptoken, err)
+}
+
+func TestPutPolicyValidate(t *testing.T) {
+	valid := []PutPolicy{
+		{Scope: "bucket"},
+		{Scope: "bucket:a:b"},
+		{Scope: "bucket", Cond: "hash=Fh8xVqod2MQ1mocfI4S4KpRL6D98&fsize=10&putTime=15000000000000000"},
+		{Scope: "bucket", Checksum: "MD5:d41d8cd98f00b204e9800998ecf8427e"},
+		{Scope: "bucket", Checksum: "sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		{Scope: "bucket", MimeLimit: "image/*;text/plain"},
+		{Scope: "bucket", MimeLimit: "!application/json"},
+	}
+	for _, p := range valid {
+		assert.NoError(t, p.Validate(), p)
+	}
+
+	invalid := []PutPolicy{
+		{Scope: ""},
+		{Scope: ":key"},
+		{Scope: "bad/bucket"},
+		{Scope: "bucket", Cond: "size=1"},
+		{Scope: "bucket", Cond: "fsize=abc"},
+		{Scope: "bucket", Cond: "hash="},
+		{Scope: "bucket", Checksum: "MD5:1234"},
+		{Scope: "bucket", Checksum: "CRC32:d41d8cd98f00b204e9800998ecf8427e"},
+		{Scope: "bucket", MimeLimit: "image"},
+		{Scope: "bucket", MimeLimit: "image/png;"},
+	}
+	for _, p := range invalid {
+		err := p.Validate()
+		assert.True(t, errors.Is(err, ErrInvalidPolicy), p)
+	}
+}
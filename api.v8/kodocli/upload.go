@@ -9,7 +9,6 @@ import (
 	"hash"
 	"hash/crc32"
 	"io"
-	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
@@ -17,9 +16,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
-	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/limit"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/rpc.v7"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/xlog.v8"
 )
@@ -125,8 +123,8 @@ func (p Uploader) put(
 	if extra.OnProgress != nil {
 		data = &readerWithProgress{reader: data, fsize: size, onProgress: extra.OnProgress}
 	}
-	tryTimes := formUploadRetryTimes
 	xl := xlog.NewWith(xlog.FromContextSafe(ctx).ReqId())
+	retrier := p.newRetrier(ctx, xl.ReqId(), RetryFormUpload, MethodForm)
 
 lzRetry:
 	if _, err = data.Seek(0, io.SeekStart); err != nil {
@@ -193,7 +191,9 @@ lzRetry:
 
 	contentType := writer.FormDataContentType()
 	var req *http.Request
-	req, err = rpc.NewRequest("POST", p.chooseUpHost(), io.MultiReader(mr, eofReaderFunc(func() {
+	mr = limit.NewReader(ctx, mr, p.RateLimit)
+	host := p.chooseUpHost()
+	req, err = rpc.NewRequest("POST", host, io.MultiReader(mr, eofReaderFunc(func() {
 		if extra.Md5Trailer != nil {
 			if m := extra.Md5Trailer(); m != nil && req != nil {
 				req.Trailer.Set("Content-Md5", base64.StdEncoding.EncodeToString(m))
@@ -213,15 +213,8 @@ lzRetry:
 		if err == Canceled {
 			return
 		}
-		code := httputil.DetectCode(err)
-		if code == 509 {
-			elog.Warn(xl.ReqId(), "formUploadRetryLater:", err)
-			time.Sleep(time.Second * time.Duration(rand.Intn(9)+1))
-			goto lzRetry
-		} else if tryTimes > 1 && (code == 406 || code/100 != 4) {
-			tryTimes--
-			elog.Warn(xl.ReqId(), "formUploadRetry:", err)
-			time.Sleep(time.Second * 3)
+		var retry bool
+		if retry, err = retrier.next(host, err); retry {
 			goto lzRetry
 		}
 		return err
@@ -404,13 +397,16 @@ func (p Uploader) put2(ctx Context, ret interface{}, uptoken, key, host string,
 				url += "/" + k + "/" + base64.URLEncoding.EncodeToString([]byte(v))
 			}
 		}
+		for k, v := range extra.XMeta {
+			url += "/x-qn-meta-" + k + "/" + base64.URLEncoding.EncodeToString([]byte(v))
+		}
 	}
 
 	if key != "" {
 		url += "/key/" + base64.URLEncoding.EncodeToString([]byte(key))
 	}
 	elog.Debug("Put2", url)
-	req, err := http.NewRequest("POST", url, data)
+	req, err := http.NewRequest("POST", url, limit.NewReader(ctx, data, p.RateLimit))
 	if err != nil {
 		return err
 	}
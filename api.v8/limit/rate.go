@@ -0,0 +1,187 @@
+package limit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// -------------------------------------------------------
+
+// RateLimit 是按字节计的令牌桶限速器，rate 为每秒允许通过的字节数，<= 0 表示不限速。
+// 令牌允许透支：一次取走超过桶内余量的字节数时，后续调用需要等待透支部分补足。
+type RateLimit struct {
+	mutex  sync.Mutex
+	rate   int64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRate(bytesPerSec int64) *RateLimit {
+
+	l := &RateLimit{}
+	l.SetRate(bytesPerSec)
+	return l
+}
+
+func (l *RateLimit) SetRate(bytesPerSec int64) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = bytesPerSec
+	l.burst = float64(bytesPerSec)
+	l.tokens = l.burst
+	l.last = time.Now()
+}
+
+func (l *RateLimit) Rate() int64 {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+func (l *RateLimit) enabled() bool {
+
+	return l != nil && l.Rate() > 0
+}
+
+// 取走 n 个字节的令牌，令牌不足时等待，ctx 取消时立即返回。
+func (l *RateLimit) WaitN(ctx context.Context, n int) error {
+
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// -------------------------------------------------------
+
+var globalRate = NewRate(0)
+
+// 设置进程内所有上传、下载共享的总带宽（字节/秒），<= 0 表示不限速。
+func SetGlobalRate(bytesPerSec int64) {
+
+	globalRate.SetRate(bytesPerSec)
+}
+
+func GlobalRate() *RateLimit {
+
+	return globalRate
+}
+
+// 返回的 limiters 包含全局限速器以及未禁用的实例限速器
+func activeLimits(limits []*RateLimit) []*RateLimit {
+
+	var active []*RateLimit
+	if globalRate.enabled() {
+		active = append(active, globalRate)
+	}
+	for _, l := range limits {
+		if l.enabled() {
+			active = append(active, l)
+		}
+	}
+	return active
+}
+
+// 单次读写的最大字节数，避免一次取走过多令牌造成长时间停顿
+const maxChunk = 32 * 1024
+
+type rateReader struct {
+	ctx    context.Context
+	r      io.Reader
+	limits []*RateLimit
+}
+
+// 包装 r，读取的数据同时受全局限速器以及 limits 的限制。
+// 每次读取时重新检查限速器是否生效，创建之后调用 SetGlobalRate、SetRate 同样对 r 生效。
+func NewReader(ctx context.Context, r io.Reader, limits ...*RateLimit) io.Reader {
+
+	return &rateReader{ctx: ctx, r: r, limits: limits}
+}
+
+func (p *rateReader) Read(b []byte) (n int, err error) {
+
+	if len(b) > maxChunk {
+		b = b[:maxChunk]
+	}
+	n, err = p.r.Read(b)
+	if n > 0 {
+		for _, l := range activeLimits(p.limits) {
+			if err1 := l.WaitN(p.ctx, n); err1 != nil {
+				return n, err1
+			}
+		}
+	}
+	return
+}
+
+type rateWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	limits []*RateLimit
+}
+
+// 包装 w，写入的数据同时受全局限速器以及 limits 的限制，限速器是否生效同样在每次写入时检查。
+func NewWriter(ctx context.Context, w io.Writer, limits ...*RateLimit) io.Writer {
+
+	return &rateWriter{ctx: ctx, w: w, limits: limits}
+}
+
+func (p *rateWriter) Write(b []byte) (n int, err error) {
+
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		for _, l := range activeLimits(p.limits) {
+			if err = l.WaitN(p.ctx, len(chunk)); err != nil {
+				return
+			}
+		}
+		n1, err := p.w.Write(chunk)
+		n += n1
+		if err != nil {
+			return n, err
+		}
+		b = b[n1:]
+	}
+	return
+}
+
+// -------------------------------------------------------
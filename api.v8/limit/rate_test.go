@@ -0,0 +1,60 @@
+package limit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateReader(t *testing.T) {
+	l := NewRate(100 * 1024)
+	data := make([]byte, 150*1024)
+
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, NewReader(context.Background(), bytes.NewReader(data), l))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, elapsed)
+	assert.True(t, elapsed < 2*time.Second, elapsed)
+}
+
+func TestRateCancel(t *testing.T) {
+	l := NewRate(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	var buf bytes.Buffer
+	_, err := NewWriter(ctx, &buf, l).Write(make([]byte, 64*1024))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestRateDisabled(t *testing.T) {
+	data := make([]byte, 64*1024)
+	start := time.Now()
+	r := NewReader(context.Background(), bytes.NewReader(data), nil, NewRate(0))
+	n, err := io.Copy(ioutil.Discard, r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestRateGlobalChanged(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(context.Background(), &buf)
+
+	// 创建之后设置的全局限速同样生效
+	SetGlobalRate(32 * 1024)
+	defer SetGlobalRate(0)
+	start := time.Now()
+	_, err := w.Write(make([]byte, 64*1024))
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+}
@@ -0,0 +1,188 @@
+package qetag
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+)
+
+// ----------------------------------------------------------
+
+const (
+	blockBits = 22 // 4M
+	blockSize = 1 << blockBits
+
+	prefixSingle = 0x16 // 只有一个块
+	prefixMulti  = 0x96 // 多个块
+	prefixParts  = 0x9e // 分片上传（v2）且分片大小没有按 4M 对齐
+)
+
+var (
+	ErrInvalidEtag  = errors.New("invalid etag")
+	ErrInvalidParts = errors.New("invalid parts")
+)
+
+// ----------------------------------------------------------
+
+// 计算数据的 etag（v1），即 Rput/Put 上传后服务端返回的 hash。
+// 数据按 4M 分块计算 sha1，只有一个块时 etag 为 0x16 + sha1，
+// 否则为 0x96 + sha1(所有块的 sha1)，最后做 urlsafe base64 编码。
+//
+func Etag(r io.Reader) (string, error) {
+
+	sha1s, _, err := blockSha1s(r)
+	if err != nil {
+		return "", err
+	}
+	return encode(sumBlocks(sha1s)), nil
+}
+
+func EtagReaderAt(r io.ReaderAt, size int64) (string, error) {
+
+	return Etag(io.NewSectionReader(r, 0, size))
+}
+
+func EtagFile(localFile string) (string, error) {
+
+	f, err := os.Open(localFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return Etag(f)
+}
+
+// ----------------------------------------------------------
+
+// 计算分片上传（v2）后对象的 etag。
+// parts 是每个分片的大小。如果除最后一个分片外都是 4M，结果与 Etag 相同；
+// 否则为 0x9e + sha1(每个分片 etag 去掉首字节后拼接)。
+//
+func EtagV2(r io.Reader, parts []int64) (string, error) {
+
+	if len(parts) == 0 {
+		return "", ErrInvalidParts
+	}
+	if isBlockAligned(parts) {
+		return Etag(r)
+	}
+
+	h := sha1.New()
+	for _, part := range parts {
+		sha1s, n, err := blockSha1s(io.LimitReader(r, part))
+		if err != nil {
+			return "", err
+		}
+		if n != part {
+			return "", io.ErrUnexpectedEOF
+		}
+		h.Write(sumBlocks(sha1s)[1:])
+	}
+	return encode(h.Sum([]byte{prefixParts})), nil
+}
+
+func EtagV2ReaderAt(r io.ReaderAt, parts []int64) (string, error) {
+
+	var size int64
+	for _, part := range parts {
+		size += part
+	}
+	return EtagV2(io.NewSectionReader(r, 0, size), parts)
+}
+
+func EtagV2File(localFile string, parts []int64) (string, error) {
+
+	f, err := os.Open(localFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return EtagV2(f, parts)
+}
+
+// 根据每个分片的大小及 uploadPart 返回的分片 etag 计算对象的 etag，不需要再读取数据。
+//
+func EtagFromParts(parts []int64, partEtags []string) (string, error) {
+
+	if len(parts) == 0 || len(parts) != len(partEtags) {
+		return "", ErrInvalidParts
+	}
+
+	aligned := isBlockAligned(parts)
+	h := sha1.New()
+	var sha1s []byte
+	for _, etag := range partEtags {
+		b, err := base64.URLEncoding.DecodeString(etag)
+		if err != nil || len(b) != sha1.Size+1 {
+			return "", ErrInvalidEtag
+		}
+		if aligned {
+			sha1s = append(sha1s, b[1:]...)
+		} else {
+			h.Write(b[1:])
+		}
+	}
+	if aligned {
+		return encode(sumBlocks(sha1s)), nil
+	}
+	return encode(h.Sum([]byte{prefixParts})), nil
+}
+
+// ----------------------------------------------------------
+
+func blockSha1s(r io.Reader) (sha1s []byte, n int64, err error) {
+
+	h := sha1.New()
+	for {
+		h.Reset()
+		n1, err := io.CopyN(h, r, blockSize)
+		if err != nil && err != io.EOF {
+			return nil, n, err
+		}
+		n += n1
+		if n1 == 0 {
+			break
+		}
+		sha1s = h.Sum(sha1s)
+		if n1 < blockSize {
+			break
+		}
+	}
+	return sha1s, n, nil
+}
+
+func sumBlocks(sha1s []byte) []byte {
+
+	if len(sha1s) == 0 {
+		empty := sha1.Sum(nil)
+		sha1s = empty[:]
+	}
+	if len(sha1s) == sha1.Size {
+		return append([]byte{prefixSingle}, sha1s...)
+	}
+	h := sha1.Sum(sha1s)
+	return append([]byte{prefixMulti}, h[:]...)
+}
+
+func isBlockAligned(parts []int64) bool {
+
+	last := len(parts) - 1
+	for i, part := range parts {
+		if i < last && part != blockSize {
+			return false
+		}
+		if i == last && part > blockSize {
+			return false
+		}
+	}
+	return true
+}
+
+func encode(b []byte) string {
+
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// ----------------------------------------------------------
@@ -0,0 +1,68 @@
+package qetag
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtag(t *testing.T) {
+	etag, err := Etag(bytes.NewReader(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "Fto5o-5ea0sNMlW_75VgGJCv2AcJ", etag)
+
+	etag, err = Etag(bytes.NewReader([]byte("hello world")))
+	assert.NoError(t, err)
+	assert.Equal(t, byte('F'), etag[0])
+	assert.Equal(t, 28, len(etag))
+
+	data := make([]byte, blockSize*2+100)
+	rand.Read(data)
+	etag, err = Etag(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, byte('l'), etag[0])
+
+	etag2, err := EtagReaderAt(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	assert.Equal(t, etag, etag2)
+}
+
+func TestEtagV2(t *testing.T) {
+	data := make([]byte, blockSize*2+100)
+	rand.Read(data)
+
+	etag, err := Etag(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	aligned := []int64{blockSize, blockSize, 100}
+	etag2, err := EtagV2(bytes.NewReader(data), aligned)
+	assert.NoError(t, err)
+	assert.Equal(t, etag, etag2)
+
+	parts := []int64{blockSize + 100, blockSize}
+	etag3, err := EtagV2ReaderAt(bytes.NewReader(data), parts)
+	assert.NoError(t, err)
+	assert.NotEqual(t, etag, etag3)
+	assert.Equal(t, byte('n'), etag3[0])
+
+	for _, ps := range [][]int64{aligned, parts} {
+		var partEtags []string
+		var off int64
+		for _, size := range ps {
+			partEtag, err := Etag(bytes.NewReader(data[off : off+size]))
+			assert.NoError(t, err)
+			partEtags = append(partEtags, partEtag)
+			off += size
+		}
+		expected, err := EtagV2(bytes.NewReader(data), ps)
+		assert.NoError(t, err)
+		actual, err := EtagFromParts(ps, partEtags)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	_, err = EtagV2(bytes.NewReader(data[:100]), parts)
+	assert.Error(t, err)
+}
@@ -0,0 +1,220 @@
+package operation
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+)
+
+// XMeta 中记录压缩方式的字段
+const metaCompress = "compress"
+
+// 压缩、加密后 XMeta 中记录的原始内容的大小和 qetag，用于比较本地文件与远端的内容是否相同
+const (
+	metaPlainSize = "plain-fsize"
+	metaPlainEtag = "plain-etag"
+)
+
+// Compressor 压缩上传的内容，Name 保存在文件的 XMeta 中，下载时据此选择解压方式。
+// 只内置了 gzip。zstd 需要第三方实现，SDK 不引入依赖，上传和下载的进程都需要先注册，比如：
+//
+//	type zstdCompressor struct{}
+//
+//	func (zstdCompressor) Name() string { return "zstd" }
+//
+//	func (zstdCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+//		return zstd.NewWriter(w)
+//	}
+//
+//	func (zstdCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+//		d, err := zstd.NewReader(r)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return d.IOReadCloser(), nil
+//	}
+//
+//	operation.RegisterCompressor(zstdCompressor{})
+type Compressor interface {
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+var (
+	compressorsMutex sync.RWMutex
+	compressors      = map[string]Compressor{"gzip": gzipCompressor{}}
+)
+
+// RegisterCompressor 注册压缩方式，已有同名的压缩方式时替换
+func RegisterCompressor(c Compressor) {
+	compressorsMutex.Lock()
+	compressors[c.Name()] = c
+	compressorsMutex.Unlock()
+}
+
+func getCompressor(name string) (Compressor, error) {
+	compressorsMutex.RLock()
+	c, ok := compressors[name]
+	compressorsMutex.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown compressor " + name + ", register it with RegisterCompressor first")
+	}
+	return c, nil
+}
+
+// ---------------------------------------------------
+
+// SetCompression 设置上传时使用的压缩方式，比如 "gzip"，为 "" 时不压缩，没有注册的压缩方式返回错误。
+// 压缩方式记录在 XMeta 中，Downloader 下载时自动解压。
+func (p *Uploader) SetCompression(name string) error {
+	if name == "" {
+		p.compressor = nil
+		return nil
+	}
+	c, err := getCompressor(name)
+	if err != nil {
+		return err
+	}
+	p.compressor = c
+	return nil
+}
+
+func (p *Uploader) compressTo(w io.Writer, r io.Reader) error {
+	cw, err := p.compressor.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(cw, r); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// transform 按设置压缩、加密上传的内容，返回处理后的内容及需要写入 XMeta 的信息，用完后需要 Close。
+// 处理后的内容不超过 spoolMemoryLimit 时保存在内存中，否则保存在临时文件中。
+// 内容经过处理时 XMeta 中同时记录原始内容的大小和 qetag。
+func (p *Uploader) transform(ctx context.Context, r io.ReaderAt, size int64) (*spooled, map[string]string, error) {
+	in := &spooled{ReaderAt: r, size: size}
+	var meta map[string]string
+	if p.compressor != nil {
+		out, err := spool(size, func(w io.Writer) error {
+			return p.compressTo(w, io.NewSectionReader(r, 0, size))
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		in, meta = out, map[string]string{metaCompress: p.compressor.Name()}
+	}
+	out, encMeta, err := p.encryptSnapshot(ctx, in, meta != nil)
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	if meta = mergeMeta(meta, encMeta); meta != nil {
+		etag, err := qetag.EtagReaderAt(r, size)
+		if err != nil {
+			out.Close()
+			return nil, nil, err
+		}
+		meta[metaPlainSize] = strconv.FormatInt(size, 10)
+		meta[metaPlainEtag] = etag
+	}
+	return out, meta, nil
+}
+
+func mergeMeta(a, b map[string]string) map[string]string {
+	if a == nil {
+		return b
+	}
+	for k, v := range b {
+		a[k] = v
+	}
+	return a
+}
+
+// ---------------------------------------------------
+
+// 压缩、加密后的内容不超过这个大小时保存在内存中，否则保存在临时文件中
+const spoolMemoryLimit = 4 << 20
+
+// spooled 是压缩、加密后的内容，file 不为 nil 时内容保存在临时文件中
+type spooled struct {
+	io.ReaderAt
+	size int64
+	file *os.File
+}
+
+// Close 删除保存内容的临时文件
+func (s *spooled) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// spool 把 write 写出的内容保存下来，sizeHint 是预计的大小，超过 spoolMemoryLimit 时写入临时文件
+func spool(sizeHint int64, write func(w io.Writer) error) (*spooled, error) {
+	if sizeHint <= spoolMemoryLimit {
+		var buf bytes.Buffer
+		buf.Grow(int(sizeHint))
+		if err := write(&buf); err != nil {
+			return nil, err
+		}
+		return &spooled{ReaderAt: bytes.NewReader(buf.Bytes()), size: int64(buf.Len())}, nil
+	}
+	tmp, err := ioutil.TempFile("", "qiniu-spool-")
+	if err != nil {
+		return nil, err
+	}
+	size := int64(0)
+	err = write(tmp)
+	if err == nil {
+		size, err = tmp.Seek(0, io.SeekCurrent)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &spooled{ReaderAt: tmp, size: size, file: tmp}, nil
+}
+
+// ---------------------------------------------------
+
+// SetRaw 为 true 时 DownloadBytes、DownloadFile 不解压，返回保存在存储中的压缩后的内容
+func (d *Downloader) SetRaw(raw bool) {
+	d.raw = raw
+}
+
+// compressorOf 返回下载内容需要的解压方式，不需要解压时返回 nil
+func (d *Downloader) compressorOf(header http.Header) (Compressor, error) {
+	name := header.Get("X-Qn-Meta-" + metaCompress)
+	if name == "" || d.raw {
+		return nil, nil
+	}
+	return getCompressor(name)
+}
@@ -0,0 +1,100 @@
+package operation
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type flateCompressor struct{}
+
+func (flateCompressor) Name() string { return "flate" }
+
+func (flateCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.BestSpeed)
+}
+
+func (flateCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// newObjectServer 返回只提供一个文件下载的服务，文件的 XMeta 为 meta
+func newObjectServer(data []byte, meta map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for k, v := range meta {
+			w.Header().Set("X-Qn-Meta-"+k, v)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	RegisterCompressor(flateCompressor{})
+	ctx := context.Background()
+
+	for _, name := range []string{"gzip", "flate"} {
+		for _, n := range []int{0, 100, spoolMemoryLimit + 1} {
+			data := bytes.Repeat([]byte("hello qiniu "), n/12+1)[:n]
+			p := &Uploader{}
+			assert.NoError(t, p.SetCompression(name))
+			content, meta, err := p.transform(ctx, bytes.NewReader(data), int64(n))
+			assert.NoError(t, err)
+			assert.Equal(t, name, meta[metaCompress])
+			assert.Equal(t, n > spoolMemoryLimit, content.file != nil)
+			compressed, err := ioutil.ReadAll(io.NewSectionReader(content, 0, content.size))
+			assert.NoError(t, err)
+			assert.NoError(t, content.Close())
+
+			srv := newObjectServer(compressed, meta)
+			d := NewDownloader(&Config{IoHosts: []string{srv.URL}, Bucket: "bucket", Ak: "ak", Sk: "sk", Retry: 1})
+			b, err := d.DownloadBytes("key")
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(data, b), "%s %d", name, n)
+
+			dir, err := ioutil.TempDir("", "compress")
+			assert.NoError(t, err)
+			path := filepath.Join(dir, "file")
+			f, err := d.DownloadFile("key", path)
+			assert.NoError(t, err)
+			f.Close()
+			b, err = ioutil.ReadFile(path)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(data, b), "%s %d", name, n)
+			os.RemoveAll(dir)
+
+			// SetRaw 时返回压缩后的内容
+			d.SetRaw(true)
+			b, err = d.DownloadBytes("key")
+			assert.NoError(t, err)
+			assert.Equal(t, compressed, b)
+			srv.Close()
+		}
+	}
+}
+
+func TestUnknownCompressor(t *testing.T) {
+	p := &Uploader{}
+	assert.Error(t, p.SetCompression("zstd"))
+	assert.NoError(t, p.SetCompression(""))
+
+	srv := newObjectServer([]byte("data"), map[string]string{metaCompress: "zstd"})
+	defer srv.Close()
+	d := NewDownloader(&Config{IoHosts: []string{srv.URL}, Bucket: "bucket", Ak: "ak", Sk: "sk", Retry: 1})
+	_, err := d.DownloadBytes("key")
+	assert.Error(t, err)
+	d.SetRaw(true)
+	b, err := d.DownloadBytes("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(b))
+}
@@ -35,6 +35,12 @@ type Config struct {
 	Sim           bool   `json:"sim" toml:"sim"`
 	DialTimeoutMs int    `json:"dial_timeout_ms"`
 	HostPinTimeMs int    `json:"host_pin_time_ms"`
+	RecordDir     string `json:"record_dir" toml:"record_dir"`
+	Verify        bool   `json:"verify" toml:"verify"`
+	UpRate        int64  `json:"up_rate" toml:"up_rate"`         // 单个 Uploader 的上传带宽（字节/秒），0 表示不限速
+	DownRate      int64  `json:"down_rate" toml:"down_rate"`     // 单个 Downloader 的下载带宽（字节/秒），0 表示不限速
+	UptokenUrl    string `json:"uptoken_url" toml:"uptoken_url"` // 上传凭证服务的地址，设置后不再用 Ak/Sk 在本地签发上传凭证
+	Compression   string `json:"compression" toml:"compression"` // 上传时的压缩方式，比如 gzip，为空时不压缩
 }
 
 func dupStrings(s []string) []string {
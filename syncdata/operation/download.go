@@ -2,6 +2,9 @@ package operation
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,9 +13,15 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/auth/qbox"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/limit"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+	xbytes "github.com/ldcsoftware/qiniu-go-sdk/x/bytes.v7"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/xlog.v8"
 )
 
 type Downloader struct {
@@ -25,6 +34,13 @@ type Downloader struct {
 
 	hostPin        *HostPin
 	downloadClient *http.Client
+	downRate       *limit.RateLimit
+
+	keys      KeyProvider
+	keyMutex  sync.Mutex
+	dataKeys  map[string][]byte
+	plainKeys map[string]bool // 已知没有加密的文件，范围下载时不再探测
+	raw       bool
 }
 
 func NewDownloader(c *Config) *Downloader {
@@ -48,6 +64,7 @@ func NewDownloader(c *Config) *Downloader {
 
 		hostPin:        NewHostPin(c.HostPinTimeMs),
 		downloadClient: downloadClient,
+		downRate:       limit.NewRate(c.DownRate),
 	}
 	update := func() []string {
 		if d.queryer != nil {
@@ -67,16 +84,28 @@ func NewDownloaderV2() *Downloader {
 	return NewDownloader(c)
 }
 
-func (d *Downloader) Retry(f func(host string) error) (err error) {
+func (d *Downloader) Retry(f func(host string) error) error {
+	return d.RetryWithContext(context.Background(), f)
+}
+
+// RetryWithContext 与 Retry 相同，重试前按指数退避等待，ctx 取消时立即返回
+func (d *Downloader) RetryWithContext(ctx context.Context, f func(host string) error) (err error) {
 	for i := 0; i < d.retry; i++ {
 		host := d.hostPin.Unpin()
 		if host == "" {
 			host = d.ioSelector.SelectHost()
 		}
 		err = f(host)
+		if err != nil && ctx.Err() != nil {
+			// 调用方取消导致的失败，不惩罚域名
+			return err
+		}
 		if shouldRetry(err) {
 			d.ioSelector.SetPunish(host)
 			elog.Info("download try failed. punish host", host, i, err)
+			if err1 := waitRetry(ctx, i, d.retry); err1 != nil {
+				return err1
+			}
 			continue
 		}
 		d.hostPin.Pin(host)
@@ -86,29 +115,88 @@ func (d *Downloader) Retry(f func(host string) error) (err error) {
 }
 
 func (d *Downloader) DownloadFile(key, path string) (f *os.File, err error) {
-	d.Retry(func(host string) error {
-		f, err = d.downloadFileInner(key, host, path)
+	return d.DownloadFileWithContext(context.Background(), key, path)
+}
+
+// DownloadFileWithContext 与 DownloadFile 相同，ctx 取消或超时时中断下载及重试，
+// ctx 中 xlog 的 reqid 通过 X-Reqid 发送
+func (d *Downloader) DownloadFileWithContext(ctx context.Context, key, path string) (f *os.File, err error) {
+	ctx = withReqId(ctx)
+	err = d.RetryWithContext(ctx, func(host string) error {
+		f, err = d.downloadFileInner(ctx, key, host, path)
 		return err
 	})
 	return
 }
 
 func (d *Downloader) DownloadBytes(key string) (data []byte, err error) {
-	d.Retry(func(host string) error {
-		data, err = d.downloadBytesInner(key, host)
+	return d.DownloadBytesWithContext(context.Background(), key)
+}
+
+// DownloadBytesWithContext 与 DownloadBytes 相同，ctx 取消或超时时中断下载及重试
+func (d *Downloader) DownloadBytesWithContext(ctx context.Context, key string) (data []byte, err error) {
+	ctx = withReqId(ctx)
+	err = d.RetryWithContext(ctx, func(host string) error {
+		data, err = d.downloadBytesInner(ctx, key, host)
 		return err
 	})
 	return
 }
 
+// DownloadRangeBytes 下载文件的一个范围，加密的文件自动解密；压缩的文件不解压，返回的是压缩后内容的范围。
+// initBuf 的容量不小于 size 时数据直接读到 initBuf 中，重复使用 initBuf 可以避免每次分配内存
 func (d *Downloader) DownloadRangeBytes(key string, offset, size int64, initBuf []byte) (l int64, data []byte, err error) {
-	d.Retry(func(host string) error {
-		l, data, err = d.downloadRangeBytesInner(key, host, offset, size, initBuf)
+	return d.DownloadRangeBytesWithContext(context.Background(), key, offset, size, initBuf)
+}
+
+// DownloadRangeBytesWithContext 与 DownloadRangeBytes 相同，ctx 取消或超时时中断下载及重试
+func (d *Downloader) DownloadRangeBytesWithContext(ctx context.Context, key string, offset, size int64, initBuf []byte) (l int64, data []byte, err error) {
+	ctx = withReqId(ctx)
+	err = d.RetryWithContext(ctx, func(host string) error {
+		l, data, err = d.downloadRangeBytesInner(ctx, key, host, offset, size, func(r io.Reader) ([]byte, error) {
+			return readRange(r, size, initBuf)
+		})
 		return err
 	})
 	return
 }
 
+// DownloadRangeBuffer 与 DownloadRangeBytes 相同，但数据读到从 bytes.DefaultPool 借用的缓冲中，
+// 用完后需要调用 bytes.DefaultPool.Put(data) 归还
+func (d *Downloader) DownloadRangeBuffer(key string, offset, size int64) (l int64, data []byte, err error) {
+	return d.DownloadRangeBufferWithContext(context.Background(), key, offset, size)
+}
+
+// DownloadRangeBufferWithContext 与 DownloadRangeBuffer 相同，ctx 取消或超时时中断下载及重试
+func (d *Downloader) DownloadRangeBufferWithContext(ctx context.Context, key string, offset, size int64) (l int64, data []byte, err error) {
+	ctx = withReqId(ctx)
+	err = d.RetryWithContext(ctx, func(host string) error {
+		l, data, err = d.downloadRangeBytesInner(ctx, key, host, offset, size, func(r io.Reader) ([]byte, error) {
+			return readPooled(r, size)
+		})
+		return err
+	})
+	return
+}
+
+// withReqId 保证 ctx 中有 xlog，同一次调用的各次重试使用相同的 reqid
+func withReqId(ctx context.Context) context.Context {
+	if _, ok := xlog.FromContext(ctx); ok {
+		return ctx
+	}
+	return xlog.NewContext(ctx, xlog.NewWith(nil))
+}
+
+// newRequest 创建绑定 ctx 的 GET 请求，并像 rpc.Client.Do 一样设置 X-Reqid
+func newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Reqid", xlog.FromContextSafe(ctx).ReqId())
+	return req, nil
+}
+
 // fileExists checks if a file exists and is not a directory before we
 // try using it to prevent further errors.
 func fileExists(filename string) bool {
@@ -119,27 +207,38 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-func (d *Downloader) downloadFileInner(key, host, path string) (*os.File, error) {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+// downloadFileInner 把文件保存在 path.part 中，并在 path.part.etag 中记录文件的 ETag 及大小。
+// 续传时通过 If-Range 确认文件没有被覆盖，文件已变化时服务端返回整个文件，从头重新下载。
+// .part 中保存的是存储中的原始内容，下载完成并校验长度及 hash 后才解密、解压到 path。
+func (d *Downloader) downloadFileInner(ctx context.Context, key, host, path string) (*os.File, error) {
+	partPath := path + ".part"
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
-	length, err := f.Seek(0, io.SeekEnd)
+	defer part.Close()
+
+	record, _ := loadPartRecord(partPath)
+	if record == nil || record.Etag == "" {
+		if err = part.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	length, err := part.Seek(0, io.SeekEnd)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("remote path", key)
 	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, d.credentials.AccessKey, d.bucket, key)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := newRequest(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Accept-Encoding", "")
 	if length != 0 {
-		r := fmt.Sprintf("bytes=%d-", length)
-		req.Header.Set("Range", r)
-		fmt.Println("continue download")
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", length))
+		req.Header.Set("If-Range", record.Etag)
+		elog.Info("continue download", key, length, record.Etag)
 	}
 
 	response, err := d.downloadClient.Do(req)
@@ -147,27 +246,172 @@ func (d *Downloader) downloadFileInner(key, host, path string) (*os.File, error)
 		return nil, err
 	}
 	defer response.Body.Close()
-	if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
-		return f, nil
+
+	total := int64(-1)
+	switch response.StatusCode {
+	case http.StatusOK:
+		// 没有续传，或者文件已变化
+		if length != 0 {
+			elog.Info("remote file changed, restart download", key, record.Etag, response.Header.Get("Etag"))
+			if err = part.Truncate(0); err != nil {
+				return nil, err
+			}
+			if _, err = part.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			length = 0
+		}
+		total = response.ContentLength
+		record = &partRecord{Etag: response.Header.Get("Etag"), Size: total}
+		if err = record.save(partPath); err != nil {
+			return nil, err
+		}
+	case http.StatusPartialContent:
+		start, err := getRangeStart(response.Header.Get("Content-Range"))
+		if err == nil && start != length {
+			err = fmt.Errorf("download resume: unexpected Content-Range %s", response.Header.Get("Content-Range"))
+		}
+		if err == nil {
+			total, err = getTotalLength(response.Header.Get("Content-Range"))
+		}
+		if err != nil {
+			part.Truncate(0)
+			return nil, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// 本地的 .part 比远端文件更长，说明不是同一个文件，从头重新下载
+		if err = part.Truncate(0); err != nil {
+			return nil, err
+		}
+		part.Close()
+		response.Body.Close()
+		return d.downloadFileInner(ctx, key, host, path)
+	default:
+		if length == 0 {
+			part.Close()
+			os.Remove(partPath)
+		}
+		return nil, httputil.NewError(response.StatusCode, response.Status)
 	}
-	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
-		return nil, errors.New(response.Status)
+
+	n, err := io.Copy(part, d.body(response))
+	if err != nil {
+		return nil, err
+	}
+	if total >= 0 && length+n != total {
+		return nil, fmt.Errorf("download length not equal, expected %d, got %d", total, length+n)
+	}
+	if err = verifyPartEtag(partPath, record.Etag); err != nil {
+		part.Truncate(0)
+		return nil, err
+	}
+	if err = part.Close(); err != nil {
+		return nil, err
 	}
-	ctLength := response.ContentLength
-	n, err := io.Copy(f, response.Body)
+	f, err := d.finishPart(ctx, response.Header, partPath, path)
 	if err != nil {
 		return nil, err
 	}
-	if ctLength != n {
-		elog.Warn("download length not equal", ctLength, n)
+	os.Remove(partRecordPath(partPath))
+	return f, nil
+}
+
+// finishPart 把下载完成的 .part 按 XMeta 解密、解压为 path，不需要处理时直接重命名
+func (d *Downloader) finishPart(ctx context.Context, header http.Header, partPath, path string) (*os.File, error) {
+	env, err := d.envelopeOf(ctx, header)
+	if err != nil {
+		return nil, err
 	}
+	c, err := d.compressorOf(header)
+	if err != nil {
+		return nil, err
+	}
+	if env == nil && c == nil {
+		if err = os.Rename(partPath, path); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(path, os.O_RDWR, 0644)
+	}
+
+	part, err := os.Open(partPath)
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+	body, _, err := d.decode(ctx, header, part, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	part.Close()
+	os.Remove(partPath)
 	f.Seek(0, io.SeekStart)
 	return f, nil
 }
 
-func (d *Downloader) downloadBytesInner(key, host string) ([]byte, error) {
+// partRecord 记录 .part 对应的远端文件，续传时用于 If-Range
+type partRecord struct {
+	Etag string `json:"etag"`
+	Size int64  `json:"size"`
+}
+
+func partRecordPath(partPath string) string {
+	return partPath + ".etag"
+}
+
+func loadPartRecord(partPath string) (*partRecord, error) {
+	data, err := ioutil.ReadFile(partRecordPath(partPath))
+	if err != nil {
+		return nil, err
+	}
+	var record partRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (r *partRecord) save(partPath string) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	path := partRecordPath(partPath)
+	if err = ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// verifyPartEtag 校验下载内容的 qetag。分片大小没有按 4M 对齐的文件无法在本地计算 etag，只校验长度
+func verifyPartEtag(partPath, etag string) error {
+	etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	raw, err := base64.URLEncoding.DecodeString(etag)
+	if err != nil || len(raw) == 0 || (raw[0] != 0x16 && raw[0] != 0x96) {
+		return nil
+	}
+	local, err := qetag.EtagFile(partPath)
+	if err != nil {
+		return err
+	}
+	if local != etag {
+		return fmt.Errorf("download hash mismatch, expected %s, got %s", etag, local)
+	}
+	return nil
+}
+
+func (d *Downloader) downloadBytesInner(ctx context.Context, key, host string) ([]byte, error) {
 	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, d.credentials.AccessKey, d.bucket, key)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := newRequest(ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -180,7 +424,50 @@ func (d *Downloader) downloadBytesInner(key, host string) ([]byte, error) {
 	if response.StatusCode != http.StatusOK {
 		return nil, errors.New(response.Status)
 	}
-	return ioutil.ReadAll(response.Body)
+	body, _, err := d.decodeBody(response)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// decodeBody 按 XMeta 解密、解压响应内容，返回内容及其长度，长度未知时为 -1
+func (d *Downloader) decodeBody(response *http.Response) (io.ReadCloser, int64, error) {
+	return d.decode(response.Request.Context(), response.Header, d.body(response), response.ContentLength)
+}
+
+// decode 按 header 中的 XMeta 解密、解压 body，length 为 body 的长度，未知时为 -1
+func (d *Downloader) decode(ctx context.Context, header http.Header, body io.Reader, length int64) (io.ReadCloser, int64, error) {
+	env, err := d.envelopeOf(ctx, header)
+	if err != nil {
+		return nil, -1, err
+	}
+	c, err := d.compressorOf(header)
+	if err != nil {
+		return nil, -1, err
+	}
+	if env != nil {
+		if length >= 0 {
+			if length, err = env.plainSize(length); err != nil {
+				return nil, -1, err
+			}
+		}
+		body = newDecryptReader(env, body)
+	}
+	if c == nil {
+		return ioutil.NopCloser(body), length, nil
+	}
+	rc, err := c.NewReader(body)
+	if err != nil {
+		return nil, -1, err
+	}
+	return rc, -1, nil
+}
+
+// body 返回受全局及该 Downloader 带宽限制的响应内容
+func (d *Downloader) body(response *http.Response) io.Reader {
+	return limit.NewReader(response.Request.Context(), response.Body, d.downRate)
 }
 
 func generateRange(offset, size int64) string {
@@ -190,56 +477,236 @@ func generateRange(offset, size int64) string {
 	return fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)
 }
 
-func readAll(r io.Reader, initBuf []byte) (b []byte, err error) {
-	// If the buffer overflows, we will get bytes.ErrTooLarge.
-	// Return that as an error. Any other panic remains.
-	defer func() {
-		e := recover()
-		if e == nil {
-			return
+// readRange 最多读取 size 字节。initBuf 的容量足够时直接读到 initBuf 中，不再分配内存；
+// 否则先读到从 bytes.DefaultPool 借用的缓冲中，再复制到按实际长度分配的 slice 并归还缓冲
+func readRange(r io.Reader, size int64, initBuf []byte) ([]byte, error) {
+	if int64(cap(initBuf)) >= size {
+		n, err := io.ReadFull(r, initBuf[:size])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
 		}
-		if panicErr, ok := e.(error); ok && panicErr == bytes.ErrTooLarge {
-			err = panicErr
-		} else {
-			panic(e)
+		if err != nil {
+			return nil, err
 		}
-	}()
-	buf := bytes.NewBuffer(initBuf[:0])
-	_, err = buf.ReadFrom(r)
-	return buf.Bytes(), err
+		return initBuf[:n], nil
+	}
+	buf, err := readPooled(r, size)
+	if err != nil {
+		return nil, err
+	}
+	defer xbytes.DefaultPool.Put(buf)
+	return append(initBuf[:0], buf...), nil
 }
 
-func (d *Downloader) downloadRangeBytesInner(key, host string, offset, size int64, initBuf []byte) (int64, []byte, error) {
-	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, d.credentials.AccessKey, d.bucket, key)
-	req, err := http.NewRequest("GET", url, nil)
+// readPooled 最多读取 size 字节到从 bytes.DefaultPool 借用的缓冲中，出错时归还缓冲
+func readPooled(r io.Reader, size int64) ([]byte, error) {
+	buf := xbytes.DefaultPool.Get(int(size))
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		xbytes.DefaultPool.Put(buf)
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (d *Downloader) downloadRangeBytesInner(ctx context.Context, key, host string, offset, size int64, read func(io.Reader) ([]byte, error)) (int64, []byte, error) {
+	if d.keys != nil {
+		return d.downloadEncryptedRange(ctx, key, host, offset, size, read)
+	}
+	response, err := d.getRange(ctx, key, host, generateRange(offset, size))
 	if err != nil {
 		return -1, nil, err
 	}
+	defer response.Body.Close()
 
-	req.Header.Set("Range", generateRange(offset, size))
+	if isEncrypted(response.Header) {
+		return -1, nil, ErrNoKeyProvider
+	}
+	l, err := getTotalLength(response.Header.Get("Content-Range"))
+	if err != nil {
+		return -1, nil, err
+	}
+	b, err := read(d.body(response))
+	return l, b, err
+}
+
+// 分段下载的过程中文件被覆盖，状态码为 412，不会重试
+var ErrObjectChanged = httputil.NewError(412, "object changed during download")
+
+// getRange 请求文件的一个范围，响应不是 206 时返回带状态码的错误
+func (d *Downloader) getRange(ctx context.Context, key, host, rangeHeader string) (*http.Response, error) {
+	return d.getRangeIf(ctx, key, host, rangeHeader, "")
+}
+
+// getRangeIf 与 getRange 相同，etag 不为空时通过 If-Range 确认文件没有变化，否则返回 ErrObjectChanged
+func (d *Downloader) getRangeIf(ctx context.Context, key, host, rangeHeader, etag string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, d.credentials.AccessKey, d.bucket, key)
+	req, err := newRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Range", rangeHeader)
+	if etag != "" {
+		req.Header.Set("If-Range", etag)
+	}
 	response, err := d.downloadClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if etag != "" && (response.StatusCode == http.StatusOK ||
+		response.StatusCode == http.StatusPartialContent && response.Header.Get("Etag") != "" && response.Header.Get("Etag") != etag) {
+		response.Body.Close()
+		return nil, ErrObjectChanged
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		response.Body.Close()
+		return nil, httputil.NewError(response.StatusCode, response.Status)
+	}
+	if response.Header.Get("Content-Range") == "" {
+		response.Body.Close()
+		return nil, errors.New("no content range")
+	}
+	return response, nil
+}
+
+// encryptedRange 返回明文范围 [offset, offset+size) 所在的块对应的密文范围及第一块的序号。
+// encryptedSize 未知时为 -1，此时密文范围的结尾可能超出文件大小。
+func (e *envelope) encryptedRange(encryptedSize, offset, size int64) (start, end, first int64) {
+	stride := e.chunkSize + encryptTagSize
+	first = offset / e.chunkSize
+	last := (offset + size - 1) / e.chunkSize
+	start, end = first*stride, (last+1)*stride-1
+	if encryptedSize >= 0 && end >= encryptedSize {
+		end = encryptedSize - 1
+	}
+	return
+}
+
+// downloadEncryptedRange 按默认的块大小请求明文范围对应的密文，解密后交给 read。
+// 文件没有加密、块大小不同或 offset 为 -1（需要先知道文件大小）时会再请求一次。
+func (d *Downloader) downloadEncryptedRange(ctx context.Context, key, host string, offset, size int64, read func(io.Reader) ([]byte, error)) (int64, []byte, error) {
+	if d.isPlain(key) {
+		response, err := d.getRange(ctx, key, host, generateRange(offset, size))
+		if err != nil {
+			return -1, nil, err
+		}
+		if !isEncrypted(response.Header) {
+			defer response.Body.Close()
+			return d.readPlainRange(response, read)
+		}
+		// 文件已被覆盖为加密的内容
+		response.Body.Close()
+		d.setPlain(key, false)
+	}
+
+	guess := &envelope{chunkSize: encryptChunkSize}
+	var guessStart, guessEnd int64
+	if offset != -1 {
+		guessStart, guessEnd, _ = guess.encryptedRange(-1, offset, size)
+	}
+	response, err := d.getRange(ctx, key, host, fmt.Sprintf("bytes=%d-%d", guessStart, guessEnd))
 	if err != nil {
 		return -1, nil, err
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusPartialContent {
-		return -1, nil, errors.New(response.Status)
+	env, err := d.envelopeOf(ctx, response.Header)
+	if err != nil {
+		return -1, nil, err
+	}
+	if env == nil {
+		// 没有加密的文件，按原来的范围重新请求，之后对该文件的范围下载不再探测
+		d.setPlain(key, true)
+		response.Body.Close()
+		response, err = d.getRange(ctx, key, host, generateRange(offset, size))
+		if err != nil {
+			return -1, nil, err
+		}
+		defer response.Body.Close()
+		return d.readPlainRange(response, read)
 	}
 
-	rangeResponse := response.Header.Get("Content-Range")
-	if rangeResponse == "" {
-		return -1, nil, errors.New("no content range")
+	total, err := getTotalLength(response.Header.Get("Content-Range"))
+	if err != nil {
+		return -1, nil, err
+	}
+	l, err := env.plainSize(total)
+	if err != nil {
+		return -1, nil, err
+	}
+	if offset == -1 {
+		if size > l {
+			size = l
+		}
+		offset = l - size
+	}
+	if offset >= l || size <= 0 {
+		return -1, nil, errors.New(http.StatusText(http.StatusRequestedRangeNotSatisfiable))
 	}
+	if offset+size > l {
+		size = l - offset
+	}
+	start, end, first := env.encryptedRange(total, offset, size)
+	// 猜测的范围超出文件结尾时服务端只返回到结尾，已经包含了需要的密文
+	if start != guessStart || end > guessEnd {
+		response.Body.Close()
+		response, err = d.getRange(ctx, key, host, fmt.Sprintf("bytes=%d-%d", start, end))
+		if err != nil {
+			return -1, nil, err
+		}
+		defer response.Body.Close()
+	}
+
+	ct, err := readPooled(d.body(response), end-start+1)
+	if err != nil {
+		return -1, nil, err
+	}
+	defer xbytes.DefaultPool.Put(ct)
+	if int64(len(ct)) != end-start+1 {
+		return -1, nil, io.ErrUnexpectedEOF
+	}
+	plain, err := env.decryptChunks(ct, first, env.chunks(l))
+	if err != nil {
+		return -1, nil, err
+	}
+	skip := offset - first*env.chunkSize
+	b, err := read(bytes.NewReader(plain[skip : skip+size]))
+	return l, b, err
+}
 
-	l, err := getTotalLength(rangeResponse)
+func (d *Downloader) readPlainRange(response *http.Response, read func(io.Reader) ([]byte, error)) (int64, []byte, error) {
+	l, err := getTotalLength(response.Header.Get("Content-Range"))
 	if err != nil {
 		return -1, nil, err
 	}
-	b, err := readAll(response.Body, initBuf)
+	b, err := read(d.body(response))
 	return l, b, err
 }
 
+func (d *Downloader) isPlain(key string) bool {
+	d.keyMutex.Lock()
+	defer d.keyMutex.Unlock()
+	return d.plainKeys[key]
+}
+
+func (d *Downloader) setPlain(key string, plain bool) {
+	d.keyMutex.Lock()
+	defer d.keyMutex.Unlock()
+	if !plain {
+		delete(d.plainKeys, key)
+		return
+	}
+	if d.plainKeys == nil || len(d.plainKeys) >= maxCachedPlainKeys {
+		d.plainKeys = make(map[string]bool)
+	}
+	d.plainKeys[key] = true
+}
+
 func getTotalLength(crange string) (int64, error) {
 	cr := strings.Split(crange, "/")
 	if len(cr) != 2 {
@@ -248,3 +715,12 @@ func getTotalLength(crange string) (int64, error) {
 
 	return strconv.ParseInt(cr[1], 10, 64)
 }
+
+// getRangeStart 返回 Content-Range 中范围的起始位置
+func getRangeStart(crange string) (int64, error) {
+	cr := strings.Split(strings.TrimPrefix(crange, "bytes "), "-")
+	if len(cr) != 2 {
+		return -1, errors.New("wrong range " + crange)
+	}
+	return strconv.ParseInt(cr[0], 10, 64)
+}
@@ -0,0 +1,205 @@
+package operation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	defaultReadAhead = 1 << 20
+	maxWindows       = 4 // 缓存的窗口数，交替读取文件中几个不同位置时不会反复请求
+)
+
+// ObjectReader 以随机访问的方式读取远端文件，由 Downloader.Open 创建。
+// 每次请求至少读取 readAhead 字节作为一个窗口缓存，最多保留 maxWindows 个最近使用的窗口，
+// 落在缓存中的读取（比如相邻的小块读取）不再发起请求。加密的文件按加密块对齐请求并解密。
+// ReadAt 可以并发调用，请求不持有锁，互不阻塞；Read、Seek 不能与其他调用并发。
+type ObjectReader struct {
+	d    *Downloader
+	ctx  context.Context
+	key  string
+	info objectInfo
+
+	mutex     sync.Mutex
+	readAhead int64
+	windows   []*window // 按最近使用排序，最近使用的在前
+	offset    int64     // Read、Seek 的当前位置
+	closed    bool
+}
+
+// window 是一段缓存的内容，从 off 开始
+type window struct {
+	off int64
+	buf []byte
+}
+
+func (w *window) contains(off int64) bool {
+	return off >= w.off && off < w.off+int64(len(w.buf))
+}
+
+// Open 打开 key 用于随机读取，文件大小来自对第一个字节的范围请求的 Content-Range。
+// 之后的请求都通过 If-Range 确认文件仍是打开时的版本，文件被覆盖后读取返回 ErrObjectChanged。
+// 压缩的文件无法按范围解压，只能在 SetRaw(true) 时打开，读到的是压缩后的内容。
+func (d *Downloader) Open(ctx context.Context, key string) (*ObjectReader, error) {
+	ctx = withReqId(ctx)
+	info, err := d.stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.compressed {
+		return nil, errors.New("open: compressed object doesn't support random access")
+	}
+	return &ObjectReader{d: d, ctx: ctx, key: key, info: info, readAhead: defaultReadAhead}, nil
+}
+
+// Size 返回文件的大小，加密的文件为解密后的大小
+func (r *ObjectReader) Size() int64 {
+	return r.info.plainSize
+}
+
+// SetReadAhead 设置每次请求最少读取的字节数，默认为 1M，小于等于 0 时只读取需要的部分
+func (r *ObjectReader) SetReadAhead(n int64) {
+	r.mutex.Lock()
+	r.readAhead = n
+	r.mutex.Unlock()
+}
+
+func (r *ObjectReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("read at: negative offset")
+	}
+	for n < len(p) && off < r.info.plainSize {
+		var w *window
+		if w, err = r.window(off, int64(len(p)-n)); err != nil {
+			return
+		}
+		c := copy(p[n:], w.buf[off-w.off:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// window 返回包含 off 的窗口，没有缓存时下载至少 n 字节。下载时不持有锁，
+// 并发读取同一位置可能重复下载，结果相同，不影响正确性。
+func (r *ObjectReader) window(off, n int64) (*window, error) {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return nil, os.ErrClosed
+	}
+	for i, w := range r.windows {
+		if w.contains(off) {
+			copy(r.windows[1:i+1], r.windows[:i])
+			r.windows[0] = w
+			r.mutex.Unlock()
+			return w, nil
+		}
+	}
+	readAhead := r.readAhead
+	r.mutex.Unlock()
+
+	w, err := r.fetch(off, n, readAhead)
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil, os.ErrClosed
+	}
+	if len(r.windows) < maxWindows {
+		r.windows = append(r.windows, nil)
+	}
+	copy(r.windows[1:], r.windows)
+	r.windows[0] = w
+	return w, nil
+}
+
+func (r *ObjectReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.info.plainSize
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close 释放缓存，之后的读取返回 os.ErrClosed
+func (r *ObjectReader) Close() error {
+	r.mutex.Lock()
+	r.closed = true
+	r.windows = nil
+	r.mutex.Unlock()
+	return nil
+}
+
+// fetch 从 off 开始读取至少 n 字节（不超过文件结尾）
+func (r *ObjectReader) fetch(off, n, readAhead int64) (w *window, err error) {
+	if n < readAhead {
+		n = readAhead
+	}
+	if off+n > r.info.plainSize {
+		n = r.info.plainSize - off
+	}
+	err = r.d.RetryWithContext(r.ctx, func(host string) error {
+		buf, bufOff, err := r.d.fetchRange(r.ctx, r.key, host, r.info, off, n)
+		if err != nil {
+			return err
+		}
+		w = &window{off: bufOff, buf: buf}
+		return nil
+	})
+	return
+}
+
+// fetchRange 下载包含 [off, off+n) 的内容，返回的内容从 bufOff 开始。
+// 加密的文件返回所在的完整的块，bufOff 为第一块的起始位置。
+func (d *Downloader) fetchRange(ctx context.Context, key, host string, info objectInfo, off, n int64) (buf []byte, bufOff int64, err error) {
+	start, end, first := off, off+n-1, int64(0)
+	if info.env != nil {
+		start, end, first = info.env.encryptedRange(info.size, off, n)
+	}
+	response, err := d.getRangeIf(ctx, key, host, fmt.Sprintf("bytes=%d-%d", start, end), info.etag)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	buf = make([]byte, end-start+1)
+	if _, err = io.ReadFull(d.body(response), buf); err != nil {
+		return nil, 0, err
+	}
+	if info.env == nil {
+		return buf, off, nil
+	}
+	buf, err = info.env.decryptChunks(buf, first, info.env.chunks(info.plainSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf, first * info.env.chunkSize, nil
+}
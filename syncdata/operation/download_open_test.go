@@ -0,0 +1,206 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectReaderReadAt(t *testing.T) {
+	data := testData(3000)
+	rs := newRangeServer(data)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	r, err := newTestDownloader(srv.URL).Open(context.Background(), "key")
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, int64(3000), r.Size())
+
+	// 第一次读取按 readAhead 请求到文件结尾，之后的读取都命中缓存
+	p := make([]byte, 100)
+	for _, off := range []int64{0, 500, 2900} {
+		n, err := r.ReadAt(p, off)
+		assert.NoError(t, err)
+		assert.Equal(t, 100, n)
+		assert.Equal(t, data[off:off+100], p)
+	}
+	assert.Equal(t, []string{"bytes=0-0", "bytes=0-2999"}, rs.ranges)
+}
+
+func TestObjectReaderReadAhead(t *testing.T) {
+	data := testData(3000)
+	rs := newRangeServer(data)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	r, err := newTestDownloader(srv.URL).Open(context.Background(), "key")
+	assert.NoError(t, err)
+	defer r.Close()
+	r.SetReadAhead(1000)
+
+	// readAhead 不超过文件结尾，读过结尾时返回 io.EOF
+	p := make([]byte, 200)
+	n, err := r.ReadAt(p, 2500)
+	assert.NoError(t, err)
+	assert.Equal(t, data[2500:2700], p[:n])
+	n, err = r.ReadAt(p, 2900)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, data[2900:], p[:n])
+	n, err = r.ReadAt(p, 3000)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+
+	// 跨越窗口的读取
+	n, err = r.ReadAt(p, 2400)
+	assert.NoError(t, err)
+	assert.Equal(t, data[2400:2600], p[:n])
+	assert.Equal(t, []string{"bytes=0-0", "bytes=2500-2999", "bytes=2400-2999"}, rs.ranges)
+}
+
+func TestObjectReaderWindows(t *testing.T) {
+	data := testData(3000)
+	rs := newRangeServer(data)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	r, err := newTestDownloader(srv.URL).Open(context.Background(), "key")
+	assert.NoError(t, err)
+	defer r.Close()
+	r.SetReadAhead(100)
+
+	p := make([]byte, 10)
+	read := func(off int64) {
+		_, err := r.ReadAt(p, off)
+		assert.NoError(t, err)
+		assert.Equal(t, data[off:off+10], p)
+	}
+	for _, off := range []int64{0, 1000, 2000, 0, 1500, 2500, 0, 1000} {
+		read(off)
+	}
+	// 0 一直在使用，不会被淘汰；1000 在读取 2500 时被淘汰
+	assert.Equal(t, []string{
+		"bytes=0-0", "bytes=0-99", "bytes=1000-1099", "bytes=2000-2099",
+		"bytes=1500-1599", "bytes=2500-2599", "bytes=1000-1099",
+	}, rs.ranges)
+}
+
+func TestObjectReaderSeek(t *testing.T) {
+	data := testData(3000)
+	srv := httptest.NewServer(newRangeServer(data))
+	defer srv.Close()
+
+	r, err := newTestDownloader(srv.URL).Open(context.Background(), "key")
+	assert.NoError(t, err)
+	defer r.Close()
+
+	p := make([]byte, 50)
+	pos, err := r.Seek(100, io.SeekStart)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), pos)
+	n, err := r.Read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, data[100:150], p[:n])
+
+	pos, err = r.Seek(10, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(160), pos)
+	n, err = r.Read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, data[160:210], p[:n])
+
+	pos, err = r.Seek(-10, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2990), pos)
+	n, err = r.Read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, data[2990:], p[:n])
+	n, err = r.Read(p)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+
+	_, err = r.Seek(-1, io.SeekStart)
+	assert.Error(t, err)
+
+	r.Seek(0, io.SeekStart)
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf.Bytes())
+}
+
+func TestObjectReaderChanged(t *testing.T) {
+	data := testData(3000)
+	rs := newRangeServer(data)
+	rs.changeAfter = 1
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	r, err := newTestDownloader(srv.URL).Open(context.Background(), "key")
+	assert.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.ReadAt(make([]byte, 10), 0)
+	assert.Equal(t, ErrObjectChanged, err)
+	assert.Equal(t, 2, rs.requests)
+}
+
+func TestObjectReaderConcurrent(t *testing.T) {
+	data := testData(3000)
+	rs := newRangeServer(data)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	r, err := newTestDownloader(srv.URL).Open(context.Background(), "key")
+	assert.NoError(t, err)
+	defer r.Close()
+	r.SetReadAhead(100)
+
+	p := make([]byte, 10)
+	_, err = r.ReadAt(p, 0)
+	assert.NoError(t, err)
+
+	// 一个读取在等待响应时，读取已缓存的内容不被阻塞
+	block := make(chan struct{})
+	rs.mutex.Lock()
+	rs.block = block
+	rs.mutex.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		q := make([]byte, 10)
+		_, err := r.ReadAt(q, 2000)
+		if err == nil && !bytes.Equal(q, data[2000:2010]) {
+			err = io.ErrUnexpectedEOF
+		}
+		done <- err
+	}()
+	for {
+		rs.mutex.Lock()
+		requests := rs.requests
+		rs.mutex.Unlock()
+		if requests == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cached := make(chan error, 1)
+	go func() {
+		_, err := r.ReadAt(p, 50)
+		cached <- err
+	}()
+	select {
+	case err = <-cached:
+		assert.NoError(t, err)
+		assert.Equal(t, data[50:60], p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached read blocked by a pending fetch")
+	}
+	close(block)
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,246 @@
+package operation
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	xbytes "github.com/ldcsoftware/qiniu-go-sdk/x/bytes.v7"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
+)
+
+const (
+	defaultParallelPartSize    = 8 << 20
+	defaultParallelConcurrency = 4
+)
+
+// ParallelOptions 是 DownloadFileParallel 的选项
+type ParallelOptions struct {
+	PartSize    int64 // 可选。每个范围的大小，默认为 8M，加密的文件按加密块的大小对齐
+	Concurrency int   // 可选。并发下载的范围数，默认为 4
+}
+
+// objectInfo 是通过范围请求得到的文件信息
+type objectInfo struct {
+	size       int64     // 密文的大小
+	plainSize  int64     // 解密后的大小
+	env        *envelope // 文件没有加密时为 nil
+	compressed bool
+	etag       string // 之后的范围请求通过 If-Range 确认文件没有变化
+}
+
+// DownloadFileParallel 把文件分成多个范围，从不同的 io 域名并发下载，每个范围单独重试，
+// 全部完成后原子地重命名为 path。压缩的文件不能按范围解压，退化为单连接下载。
+// 下载过程中文件被覆盖时返回 ErrObjectChanged，path 保持不变。
+func (d *Downloader) DownloadFileParallel(ctx context.Context, key, path string, opts *ParallelOptions) error {
+	if opts == nil {
+		opts = &ParallelOptions{}
+	}
+	partSize := opts.PartSize
+	if partSize <= 0 {
+		partSize = defaultParallelPartSize
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultParallelConcurrency
+	}
+
+	ctx = withReqId(ctx)
+	info, err := d.stat(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if info.compressed || info.plainSize == 0 {
+		// downloadFileInner 完成后才把内容放到 path
+		var f *os.File
+		err = d.RetryWithContext(ctx, func(host string) error {
+			f, err = d.downloadFileInner(ctx, key, host, path)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	err = d.downloadRanges(ctx, tmp, key, info, partSize, concurrency)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// stat 请求文件的第一个字节，得到文件的大小及加密、压缩信息
+func (d *Downloader) stat(ctx context.Context, key string) (info objectInfo, err error) {
+	err = d.RetryWithContext(ctx, func(host string) error {
+		response, err := d.getRange(ctx, key, host, "bytes=0-0")
+		if err != nil {
+			if httputil.DetectCode(err) == 416 { // 空文件
+				info = objectInfo{}
+				return nil
+			}
+			return err
+		}
+		response.Body.Close()
+
+		info.etag = response.Header.Get("Etag")
+		info.size, err = getTotalLength(response.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		info.plainSize = info.size
+		info.env, err = d.envelopeOf(ctx, response.Header)
+		if err != nil {
+			return err
+		}
+		if info.env != nil {
+			if info.plainSize, err = info.env.plainSize(info.size); err != nil {
+				return err
+			}
+		}
+		c, err := d.compressorOf(response.Header)
+		info.compressed = c != nil
+		return err
+	})
+	return
+}
+
+func (d *Downloader) downloadRanges(ctx context.Context, f *os.File, key string, info objectInfo, partSize int64, concurrency int) error {
+	if info.env != nil && partSize%info.env.chunkSize != 0 {
+		partSize = (partSize/info.env.chunkSize + 1) * info.env.chunkSize
+	}
+	if err := f.Truncate(info.plainSize); err != nil {
+		return err
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	offsets := make(chan int64)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := range offsets {
+				n := partSize
+				if off+n > info.plainSize {
+					n = info.plainSize - off
+				}
+				if err := d.downloadRangeWithRetry(ctx, f, key, info, off, n); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for off := int64(0); off < info.plainSize; off += partSize {
+		select {
+		case offsets <- off:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(offsets)
+	wg.Wait()
+	if err := parent.Err(); err != nil {
+		// 调用方取消时各个范围返回的是包装过的错误
+		return err
+	}
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// downloadRangeWithRetry 每次尝试都从 ioSelector 选择 io 域名，使各个范围分散到不同的域名上
+func (d *Downloader) downloadRangeWithRetry(ctx context.Context, f *os.File, key string, info objectInfo, off, n int64) (err error) {
+	for i := 0; i < d.retry; i++ {
+		host := d.ioSelector.SelectHost()
+		err = d.downloadRangeTo(ctx, f, key, host, info, off, n)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if !shouldRetry(err) {
+			return
+		}
+		d.ioSelector.SetPunish(host)
+		elog.Info("download range failed. punish host", host, key, off, i, err)
+		if err1 := waitRetry(ctx, i, d.retry); err1 != nil {
+			return err1
+		}
+	}
+	return
+}
+
+func (d *Downloader) downloadRangeTo(ctx context.Context, f *os.File, key, host string, info objectInfo, off, n int64) error {
+	start, end, first := off, off+n-1, int64(0)
+	if info.env != nil {
+		start, end, first = info.env.encryptedRange(info.size, off, n)
+	}
+	response, err := d.getRangeIf(ctx, key, host, fmt.Sprintf("bytes=%d-%d", start, end), info.etag)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if info.env == nil {
+		_, err = io.CopyN(&offsetWriter{f: f, off: off}, d.body(response), n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	ct := xbytes.DefaultPool.Get(int(end - start + 1))
+	defer xbytes.DefaultPool.Put(ct)
+	if _, err = io.ReadFull(d.body(response), ct); err != nil {
+		return err
+	}
+	plain, err := info.env.decryptChunks(ct, first, info.env.chunks(info.plainSize))
+	if err != nil {
+		return err
+	}
+	if int64(len(plain)) != n {
+		return io.ErrUnexpectedEOF
+	}
+	_, err = f.WriteAt(plain, off)
+	return err
+}
+
+// offsetWriter 从 off 开始顺序写入 f
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
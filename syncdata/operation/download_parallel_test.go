@@ -0,0 +1,214 @@
+package operation
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeServer 模拟 io 的范围下载，支持 Range 和 If-Range
+type rangeServer struct {
+	mutex       sync.Mutex
+	data        []byte
+	etag        string
+	meta        map[string]string // 文件的 XMeta
+	ranges      []string          // 收到的 Range
+	fail        map[string]int    // 对这些 Range 先返回 503 的次数
+	changeAfter int               // 大于 0 时，收到这么多请求后文件被覆盖
+	block       chan struct{}     // 不为 nil 时等到关闭或者请求取消后再响应
+	requests    int
+}
+
+func newRangeServer(data []byte) *rangeServer {
+	return &rangeServer{data: data, etag: `"v1"`, fail: map[string]int{}}
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	s.requests++
+	if s.changeAfter > 0 && s.requests > s.changeAfter {
+		s.etag = `"v2"`
+	}
+	rg := req.Header.Get("Range")
+	s.ranges = append(s.ranges, rg)
+	fail := s.fail[rg] > 0
+	if fail {
+		s.fail[rg]--
+	}
+	data, etag, meta, block := s.data, s.etag, s.meta, s.block
+	s.mutex.Unlock()
+
+	if block != nil {
+		select {
+		case <-block:
+		case <-req.Context().Done():
+			return
+		}
+	}
+	if fail {
+		w.WriteHeader(503)
+		return
+	}
+	w.Header().Set("Etag", etag)
+	for k, v := range meta {
+		w.Header().Set("X-Qn-Meta-"+k, v)
+	}
+	ifRange := req.Header.Get("If-Range")
+	if rg == "" || ifRange != "" && ifRange != etag {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(200)
+		w.Write(data)
+		return
+	}
+	start, end, ok := parseTestRange(rg, int64(len(data)))
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+		w.WriteHeader(416)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(206)
+	w.Write(data[start : end+1])
+}
+
+// rangesWith 返回收到的以 prefix 开头的 Range，按起始位置排序
+func (s *rangeServer) rangesWith(prefix string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var ranges []string
+	for _, rg := range s.ranges {
+		if strings.HasPrefix(rg, prefix) {
+			ranges = append(ranges, rg)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		a, _, _ := parseTestRange(ranges[i], 1<<62)
+		b, _, _ := parseTestRange(ranges[j], 1<<62)
+		return a < b
+	})
+	return ranges
+}
+
+func parseTestRange(rg string, size int64) (start, end int64, ok bool) {
+	ps := strings.Split(strings.TrimPrefix(rg, "bytes="), "-")
+	if ps[0] == "" {
+		n, _ := strconv.ParseInt(ps[1], 10, 64)
+		start, end = size-n, size-1
+		if start < 0 {
+			start = 0
+		}
+	} else {
+		start, _ = strconv.ParseInt(ps[0], 10, 64)
+		end = size - 1
+		if ps[1] != "" {
+			end, _ = strconv.ParseInt(ps[1], 10, 64)
+		}
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return start, end, start <= end
+}
+
+func newTestDownloader(url string) *Downloader {
+	return NewDownloader(&Config{IoHosts: []string{url}, Bucket: "bucket", Ak: "ak", Sk: "sk", Retry: 3})
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestDownloadFileParallel(t *testing.T) {
+	data := testData(3500)
+	s := newRangeServer(data)
+	s.fail["bytes=1000-1999"] = 1
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "parallel")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	d := newTestDownloader(srv.URL)
+	err = d.DownloadFileParallel(context.Background(), "key", path, &ParallelOptions{PartSize: 1000, Concurrency: 2})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	// 最后一个范围不足 PartSize，失败的范围单独重试
+	assert.Equal(t, []string{"bytes=0-0", "bytes=0-999", "bytes=1000-1999", "bytes=1000-1999", "bytes=2000-2999", "bytes=3000-3499"},
+		s.rangesWith("bytes="))
+}
+
+func TestDownloadFileParallelChanged(t *testing.T) {
+	s := newRangeServer(testData(3500))
+	s.changeAfter = 1 // 第一个请求（stat）之后文件被覆盖
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "parallel")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	d := newTestDownloader(srv.URL)
+	err = d.DownloadFileParallel(context.Background(), "key", path, &ParallelOptions{PartSize: 1000, Concurrency: 2})
+	assert.Equal(t, ErrObjectChanged, err)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestDownloadFileParallelCancel(t *testing.T) {
+	s := newRangeServer(testData(3500))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "parallel")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	d := newTestDownloader(srv.URL)
+	info, err := d.stat(context.Background(), "key")
+	assert.NoError(t, err)
+
+	// stat 之后的请求都不返回，直到被取消
+	s.mutex.Lock()
+	s.block = make(chan struct{})
+	s.mutex.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	f, err := ioutil.TempFile(dir, "tmp")
+	assert.NoError(t, err)
+	defer f.Close()
+	start := time.Now()
+	err = d.downloadRanges(ctx, f, "key", info, 1000, 2)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	err = d.DownloadFileParallel(ctx, "key", path, nil)
+	assert.Error(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	close(s.block)
+}
@@ -0,0 +1,254 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/xlog.v8"
+	"github.com/stretchr/testify/assert"
+)
+
+// preparePart 模拟上次中断的下载，留下 .part 及其 .part.etag
+func preparePart(t *testing.T, path string, content []byte, etag string) {
+	partPath := path + ".part"
+	assert.NoError(t, ioutil.WriteFile(partPath, content, 0644))
+	assert.NoError(t, (&partRecord{Etag: etag, Size: int64(len(content))}).save(partPath))
+}
+
+func assertDownloaded(t *testing.T, path string, data []byte) {
+	got, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+	_, err = os.Stat(path + ".part")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + ".part.etag")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	data := testData(3000)
+	rs := newRangeServer(data)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	preparePart(t, path, data[:1000], `"v1"`)
+	f, err := newTestDownloader(srv.URL).DownloadFile("key", path)
+	assert.NoError(t, err)
+	f.Close()
+	assertDownloaded(t, path, data)
+	assert.Equal(t, []string{"bytes=1000-"}, rs.rangesWith("bytes="))
+}
+
+func TestDownloadFileResumeChanged(t *testing.T) {
+	data := testData(3000)
+	srv := httptest.NewServer(newRangeServer(data))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 远端文件已被覆盖，If-Range 不匹配时服务端返回 200 和整个文件
+	path := filepath.Join(dir, "file")
+	preparePart(t, path, []byte("stale content"), `"v0"`)
+	f, err := newTestDownloader(srv.URL).DownloadFile("key", path)
+	assert.NoError(t, err)
+	f.Close()
+	assertDownloaded(t, path, data)
+}
+
+func TestDownloadFileResumeBadRange(t *testing.T) {
+	data := testData(3000)
+	rs := newRangeServer(data)
+	wrongStart := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Range") != "" && wrongStart {
+			wrongStart = false
+			w.Header().Set("Etag", `"v1"`)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+			w.WriteHeader(206)
+			w.Write(data)
+			return
+		}
+		rs.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 返回的起始位置与 .part 长度不一致时丢弃 .part，重试时从头下载
+	path := filepath.Join(dir, "file")
+	preparePart(t, path, data[:1000], `"v1"`)
+	f, err := newTestDownloader(srv.URL).DownloadFile("key", path)
+	assert.NoError(t, err)
+	f.Close()
+	assertDownloaded(t, path, data)
+	assert.False(t, wrongStart)
+	assert.Equal(t, []string{""}, rs.rangesWith(""))
+}
+
+func TestDownloadFileResumeNotSatisfiable(t *testing.T) {
+	data := testData(3000)
+	rs := newRangeServer(data)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// .part 比远端文件还长，服务端返回 416，从头重新下载
+	path := filepath.Join(dir, "file")
+	preparePart(t, path, testData(4000), `"v1"`)
+	f, err := newTestDownloader(srv.URL).DownloadFile("key", path)
+	assert.NoError(t, err)
+	f.Close()
+	assertDownloaded(t, path, data)
+	assert.Equal(t, []string{"bytes=4000-", ""}, rs.ranges)
+}
+
+func TestDownloadFileHashMismatch(t *testing.T) {
+	data := testData(3000)
+	etag, err := qetag.Etag(bytes.NewReader(data[:2999]))
+	assert.NoError(t, err)
+	rs := newRangeServer(data)
+	rs.etag = `"` + etag + `"`
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	_, err = newTestDownloader(srv.URL).DownloadFile("key", path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hash mismatch")
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	info, err := os.Stat(path + ".part")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+// reqIdServer 记录每个请求的 X-Reqid 后交给 rangeServer 处理
+type reqIdServer struct {
+	*rangeServer
+	reqIds []string
+}
+
+func (s *reqIdServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	s.reqIds = append(s.reqIds, req.Header.Get("X-Reqid"))
+	s.mutex.Unlock()
+	s.rangeServer.ServeHTTP(w, req)
+}
+
+func TestDownloadReqId(t *testing.T) {
+	data := testData(3000)
+	dir, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	calls := map[string]func(ctx context.Context, d *Downloader) error{
+		"file": func(ctx context.Context, d *Downloader) error {
+			f, err := d.DownloadFileWithContext(ctx, "key", filepath.Join(dir, "file"))
+			if err == nil {
+				f.Close()
+			}
+			return err
+		},
+		"bytes": func(ctx context.Context, d *Downloader) error {
+			_, err := d.DownloadBytesWithContext(ctx, "key")
+			return err
+		},
+		"range": func(ctx context.Context, d *Downloader) error {
+			_, _, err := d.DownloadRangeBytesWithContext(ctx, "key", 100, 10, nil)
+			return err
+		},
+	}
+	for name, call := range calls {
+		for _, reqId := range []string{"", "my-reqid"} {
+			// 前两次请求失败，三次请求使用相同的 reqid；ctx 中有 xlog 时使用它的 reqid
+			rs := &reqIdServer{rangeServer: newRangeServer(data)}
+			rs.fail[""], rs.fail["bytes=100-109"] = 2, 2
+			srv := httptest.NewServer(rs)
+			ctx := context.Background()
+			if reqId != "" {
+				ctx = xlog.NewContext(ctx, xlog.NewWith(reqId))
+			}
+			assert.NoError(t, call(ctx, newTestDownloader(srv.URL)), name)
+			srv.Close()
+
+			if assert.Len(t, rs.reqIds, 3, name) {
+				assert.NotEmpty(t, rs.reqIds[0], name)
+				assert.Equal(t, rs.reqIds[0], rs.reqIds[1], name)
+				assert.Equal(t, rs.reqIds[0], rs.reqIds[2], name)
+				if reqId != "" {
+					assert.Equal(t, reqId, rs.reqIds[0], name)
+				}
+			}
+		}
+	}
+}
+
+func TestDownloadCancelRetry(t *testing.T) {
+	rs := newRangeServer(testData(3000))
+	rs.fail[""] = 1000
+	var onRequest func()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rs.mutex.Lock()
+		f := onRequest
+		rs.mutex.Unlock()
+		if f != nil {
+			f()
+		}
+		rs.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	d := NewDownloader(&Config{IoHosts: []string{srv.URL}, Bucket: "bucket", Ak: "ak", Sk: "sk", Retry: 1000})
+	requests := func() int {
+		rs.mutex.Lock()
+		defer rs.mutex.Unlock()
+		return rs.requests
+	}
+
+	// 第一次请求时取消，不再重试
+	ctx, cancel := context.WithCancel(context.Background())
+	onRequest = cancel
+	_, err := d.DownloadBytesWithContext(ctx, "key")
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	assert.Equal(t, 1, requests())
+
+	// 已经取消的 ctx 不发出请求
+	_, err = d.DownloadBytesWithContext(ctx, "key")
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	assert.Equal(t, 1, requests())
+
+	// 在重试的等待中超时，返回后不再发出请求
+	rs.mutex.Lock()
+	onRequest = nil
+	rs.mutex.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = d.DownloadBytesWithContext(ctx, "key")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+	n := requests()
+	assert.True(t, n > 1 && n < 1000, "%d requests", n)
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, n, requests())
+}
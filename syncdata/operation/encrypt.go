@@ -0,0 +1,441 @@
+package operation
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// 客户端信封加密：每个文件使用随机生成的数据密钥，明文按 encryptChunkSize 切块后分别用 AES-256-GCM 加密，
+// 每块的密文为明文加 16 字节的 tag，因此可以按明文的范围计算出密文的范围。
+// 数据密钥由 KeyProvider 加密后与算法参数一起保存在文件的 XMeta 中。
+const (
+	encryptAlgorithm = "AES-256-GCM"
+	encryptChunkSize = 64 << 10
+	encryptTagSize   = 16
+	encryptNonceSize = 12
+	dataKeySize      = 32
+
+	metaEncryptAlg   = "encrypt-alg"
+	metaEncryptChunk = "encrypt-chunk"
+	metaEncryptKeyId = "encrypt-key-id"
+	metaEncryptKey   = "encrypt-key"
+	metaEncryptNonce = "encrypt-nonce"
+)
+
+var (
+	ErrNoKeyProvider = errors.New("object is encrypted but no key provider is set")
+
+	errUnsupportedEncryption = errors.New("unsupported encryption algorithm")
+	errInvalidEncryptMeta    = errors.New("invalid encryption meta")
+	errEncryptNotSupported   = errors.New("encryption is not supported by this upload method")
+)
+
+// KeyProvider 生成和解开数据密钥，主密钥可以保存在本地或 KMS 中
+type KeyProvider interface {
+	// GenerateDataKey 生成 32 字节的数据密钥，返回明文、用主密钥加密后的密文及主密钥的标识
+	GenerateDataKey(ctx context.Context) (plain, wrapped []byte, keyId string, err error)
+	// DecryptDataKey 用 keyId 对应的主密钥解开 GenerateDataKey 返回的 wrapped
+	DecryptDataKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error)
+}
+
+// ---------------------------------------------------
+
+type localKeyProvider struct {
+	keyId  string
+	master cipher.AEAD
+}
+
+// NewLocalKeyProvider 使用本地的 32 字节主密钥加密数据密钥，keyId 会保存在文件的 XMeta 中
+func NewLocalKeyProvider(keyId string, masterKey []byte) (KeyProvider, error) {
+	if len(masterKey) != dataKeySize {
+		return nil, errors.New("master key must be 32 bytes")
+	}
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &localKeyProvider{keyId: keyId, master: aead}, nil
+}
+
+func (p *localKeyProvider) GenerateDataKey(ctx context.Context) (plain, wrapped []byte, keyId string, err error) {
+	plain = make([]byte, dataKeySize)
+	nonce := make([]byte, encryptNonceSize)
+	if _, err = rand.Read(plain); err != nil {
+		return
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	wrapped = p.master.Seal(nonce, nonce, plain, []byte(p.keyId))
+	return plain, wrapped, p.keyId, nil
+}
+
+func (p *localKeyProvider) DecryptDataKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error) {
+	if keyId != p.keyId {
+		return nil, errors.New("unknown master key id " + strconv.Quote(keyId))
+	}
+	if len(wrapped) < encryptNonceSize {
+		return nil, errInvalidEncryptMeta
+	}
+	return p.master.Open(nil, wrapped[:encryptNonceSize], wrapped[encryptNonceSize:], []byte(keyId))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ---------------------------------------------------
+
+// envelope 加解密一个文件的各个块。第 idx 块的 nonce 为基础 nonce 的后 8 字节异或 idx，
+// 附加数据为 idx 及是否最后一块，防止块被调换或截断。
+type envelope struct {
+	aead      cipher.AEAD
+	nonce     []byte
+	chunkSize int64
+}
+
+func newEnvelope(key, nonce []byte, chunkSize int64) (*envelope, error) {
+	if len(nonce) != encryptNonceSize || chunkSize <= 0 {
+		return nil, errInvalidEncryptMeta
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{aead: aead, nonce: nonce, chunkSize: chunkSize}, nil
+}
+
+func (e *envelope) chunkNonce(idx int64) []byte {
+	nonce := make([]byte, encryptNonceSize)
+	copy(nonce, e.nonce)
+	ctr := binary.BigEndian.Uint64(nonce[4:]) ^ uint64(idx)
+	binary.BigEndian.PutUint64(nonce[4:], ctr)
+	return nonce
+}
+
+func chunkAAD(idx int64, last bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(idx))
+	if last {
+		aad[8] = 1
+	}
+	return aad
+}
+
+func (e *envelope) seal(dst []byte, idx int64, last bool, plain []byte) []byte {
+	return e.aead.Seal(dst, e.chunkNonce(idx), plain, chunkAAD(idx, last))
+}
+
+// open 解密一块，明文写回 ct 的空间
+func (e *envelope) open(idx int64, last bool, ct []byte) ([]byte, error) {
+	return e.aead.Open(ct[:0], e.chunkNonce(idx), ct, chunkAAD(idx, last))
+}
+
+// 明文大小为 size 时的块数，空文件也有一块
+func (e *envelope) chunks(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + e.chunkSize - 1) / e.chunkSize
+}
+
+func (e *envelope) encryptedSize(size int64) int64 {
+	return size + e.chunks(size)*encryptTagSize
+}
+
+func (e *envelope) plainSize(encryptedSize int64) (int64, error) {
+	n := (encryptedSize + e.chunkSize + encryptTagSize - 1) / (e.chunkSize + encryptTagSize)
+	if n == 0 || encryptedSize-n*encryptTagSize < 0 {
+		return 0, errInvalidEncryptMeta
+	}
+	return encryptedSize - n*encryptTagSize, nil
+}
+
+// decryptChunks 解密从第 first 块开始的连续若干块密文，n 为文件的总块数
+func (e *envelope) decryptChunks(ct []byte, first, n int64) ([]byte, error) {
+	stride := int(e.chunkSize + encryptTagSize)
+	plain := ct[:0]
+	for idx := first; len(ct) > 0; idx++ {
+		c := stride
+		if c > len(ct) {
+			c = len(ct)
+		}
+		b, err := e.open(idx, idx == n-1, ct[:c])
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, b...)
+		ct = ct[c:]
+	}
+	return plain, nil
+}
+
+func (e *envelope) meta(keyId string, wrapped []byte) map[string]string {
+	return map[string]string{
+		metaEncryptAlg:   encryptAlgorithm,
+		metaEncryptChunk: strconv.FormatInt(e.chunkSize, 10),
+		metaEncryptKeyId: keyId,
+		metaEncryptKey:   base64.URLEncoding.EncodeToString(wrapped),
+		metaEncryptNonce: base64.URLEncoding.EncodeToString(e.nonce),
+	}
+}
+
+// ---------------------------------------------------
+
+// encryptReaderAt 按块加密 r 的内容，支持并发的 ReadAt
+type encryptReaderAt struct {
+	env  *envelope
+	r    io.ReaderAt
+	size int64 // 明文大小
+
+	mutex   sync.Mutex
+	lastIdx int64
+	last    []byte // 最近加密的一块，顺序读取时避免重复加密
+}
+
+func (r *encryptReaderAt) chunk(idx int64) ([]byte, error) {
+	r.mutex.Lock()
+	if r.last != nil && r.lastIdx == idx {
+		ct := r.last
+		r.mutex.Unlock()
+		return ct, nil
+	}
+	r.mutex.Unlock()
+
+	off := idx * r.env.chunkSize
+	n := r.size - off
+	if n > r.env.chunkSize {
+		n = r.env.chunkSize
+	}
+	plain := make([]byte, n, n+encryptTagSize)
+	if m, err := r.r.ReadAt(plain, off); m < len(plain) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	ct := r.env.seal(plain[:0], idx, idx == r.env.chunks(r.size)-1, plain)
+
+	r.mutex.Lock()
+	r.lastIdx, r.last = idx, ct
+	r.mutex.Unlock()
+	return ct, nil
+}
+
+func (r *encryptReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	total := r.env.encryptedSize(r.size)
+	stride := r.env.chunkSize + encryptTagSize
+	for len(p) > 0 && off < total {
+		ct, err := r.chunk(off / stride)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p, ct[off%stride:])
+		n += c
+		p = p[c:]
+		off += int64(c)
+	}
+	if len(p) > 0 {
+		err = io.EOF
+	}
+	return
+}
+
+// readSeekerAt 把 io.ReadSeeker 转换为 io.ReaderAt
+type readSeekerAt struct {
+	mutex sync.Mutex
+	rs    io.ReadSeeker
+}
+
+func (r *readSeekerAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r.rs, p)
+}
+
+// ---------------------------------------------------
+
+// decryptReader 顺序解密整个文件的密文
+type decryptReader struct {
+	env   *envelope
+	r     *bufio.Reader
+	idx   int64
+	buf   []byte
+	plain []byte
+	done  bool
+}
+
+func newDecryptReader(env *envelope, r io.Reader) *decryptReader {
+	return &decryptReader{
+		env: env,
+		r:   bufio.NewReader(r),
+		buf: make([]byte, env.chunkSize+encryptTagSize),
+	}
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.r, r.buf)
+		last := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			last = true
+		} else if err != nil {
+			return 0, err
+		} else if _, err = r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return 0, err
+		}
+		r.plain, err = r.env.open(r.idx, last, r.buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		r.idx++
+		r.done = last
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// ---------------------------------------------------
+
+func isEncrypted(header http.Header) bool {
+	return header.Get("X-Qn-Meta-"+metaEncryptAlg) != ""
+}
+
+// SetKeyProvider 开启客户端加密，之后上传的文件在本地加密，数据密钥由 kp 加密后保存在 XMeta 中。
+// 为 nil 时关闭加密。UploadWithDataChan 和 NewWriter 不支持加密。
+// XMeta 中还会记录明文的大小和 qetag 用于同步时比较内容，能够据此确认文件是否是某个已知的明文。
+func (p *Uploader) SetKeyProvider(kp KeyProvider) {
+	p.keys = kp
+}
+
+// encrypt 开启加密时返回加密后的内容、大小及需要写入 XMeta 的加密信息，否则原样返回
+func (p *Uploader) encrypt(ctx context.Context, r io.ReaderAt, size int64) (io.ReaderAt, int64, map[string]string, error) {
+	if p.keys == nil {
+		return r, size, nil, nil
+	}
+	key, wrapped, keyId, err := p.keys.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	nonce := make([]byte, encryptNonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, 0, nil, err
+	}
+	env, err := newEnvelope(key, nonce, encryptChunkSize)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	er := &encryptReaderAt{env: env, r: r, size: size}
+	return er, env.encryptedSize(size), env.meta(keyId, wrapped), nil
+}
+
+// encryptSnapshot 开启加密时返回 in 加密后的内容及需要写入 XMeta 的加密信息，否则原样返回 in。
+// 同一个数据密钥和 nonce 只能加密一次明文，in 在上传过程中可能变化时（比如正在写入的本地文件），
+// 先把密文完整保存下来，重试和重新计算 hash 时读到的都是同一份密文。
+// stable 为 true 表示 in 是不会变化的私有副本（比如压缩后的临时文件），此时在读取时按块加密。
+// 成功时返回的内容取代 in，由返回的内容负责关闭 in；出错时 in 由调用方关闭。
+func (p *Uploader) encryptSnapshot(ctx context.Context, in *spooled, stable bool) (*spooled, map[string]string, error) {
+	data, size, meta, err := p.encrypt(ctx, in, in.size)
+	if err != nil || meta == nil {
+		return in, nil, err
+	}
+	if stable {
+		return &spooled{ReaderAt: data, size: size, file: in.file}, meta, nil
+	}
+	out, err := spool(size, func(w io.Writer) error {
+		_, err := io.Copy(w, io.NewSectionReader(data, 0, size))
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	in.Close()
+	return out, meta, nil
+}
+
+// SetKeyProvider 设置解开数据密钥的 KeyProvider，之后下载加密的文件时自动解密。
+// 没有设置时下载加密的文件返回 ErrNoKeyProvider。
+func (d *Downloader) SetKeyProvider(kp KeyProvider) {
+	d.keys = kp
+}
+
+// envelopeOf 根据响应中的 XMeta 返回解密用的 envelope，文件没有加密时返回 nil
+func (d *Downloader) envelopeOf(ctx context.Context, header http.Header) (*envelope, error) {
+	alg := header.Get("X-Qn-Meta-" + metaEncryptAlg)
+	if alg == "" {
+		return nil, nil
+	}
+	if d.keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	if alg != encryptAlgorithm {
+		return nil, errUnsupportedEncryption
+	}
+	chunkSize, err := strconv.ParseInt(header.Get("X-Qn-Meta-"+metaEncryptChunk), 10, 64)
+	if err != nil {
+		return nil, errInvalidEncryptMeta
+	}
+	wrapped, err := base64.URLEncoding.DecodeString(header.Get("X-Qn-Meta-" + metaEncryptKey))
+	if err != nil {
+		return nil, errInvalidEncryptMeta
+	}
+	nonce, err := base64.URLEncoding.DecodeString(header.Get("X-Qn-Meta-" + metaEncryptNonce))
+	if err != nil {
+		return nil, errInvalidEncryptMeta
+	}
+	key, err := d.dataKey(ctx, header.Get("X-Qn-Meta-"+metaEncryptKeyId), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newEnvelope(key, nonce, chunkSize)
+}
+
+const maxCachedDataKeys = 1024
+
+// 开启解密时缓存的已知没有加密的文件数
+const maxCachedPlainKeys = 10000
+
+// dataKey 解开数据密钥，结果按 wrapped 缓存，避免范围下载时反复请求 KeyProvider
+func (d *Downloader) dataKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error) {
+	cacheKey := keyId + ":" + string(wrapped)
+	d.keyMutex.Lock()
+	key, ok := d.dataKeys[cacheKey]
+	d.keyMutex.Unlock()
+	if ok {
+		return key, nil
+	}
+	key, err := d.keys.DecryptDataKey(ctx, keyId, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	d.keyMutex.Lock()
+	if d.dataKeys == nil || len(d.dataKeys) >= maxCachedDataKeys {
+		d.dataKeys = make(map[string][]byte)
+	}
+	d.dataKeys[cacheKey] = key
+	d.keyMutex.Unlock()
+	return key, nil
+}
@@ -0,0 +1,268 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelope(t *testing.T) {
+	kp, err := NewLocalKeyProvider("k1", bytes.Repeat([]byte{1}, 32))
+	assert.NoError(t, err)
+	p := &Uploader{keys: kp}
+	d := &Downloader{keys: kp}
+
+	for _, n := range []int{0, 1, encryptChunkSize, encryptChunkSize + 1, 3*encryptChunkSize - 5} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i * 13)
+		}
+		r, size, meta, err := p.encrypt(context.Background(), bytes.NewReader(data), int64(n))
+		assert.NoError(t, err)
+		ct, err := ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+		assert.NoError(t, err)
+		assert.Equal(t, size, int64(len(ct)))
+
+		header := make(http.Header)
+		for k, v := range meta {
+			header.Set("X-Qn-Meta-"+k, v)
+		}
+		env, err := d.envelopeOf(context.Background(), header)
+		assert.NoError(t, err)
+		l, err := env.plainSize(size)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(n), l)
+
+		plain, err := ioutil.ReadAll(newDecryptReader(env, bytes.NewReader(ct)))
+		assert.NoError(t, err)
+		assert.Equal(t, data, plain)
+
+		if n > 1 {
+			// 截断最后一块应当解密失败
+			_, err = ioutil.ReadAll(newDecryptReader(env, bytes.NewReader(ct[:len(ct)-encryptTagSize-1])))
+			assert.Error(t, err)
+		}
+	}
+}
+
+func TestEncryptSnapshot(t *testing.T) {
+	kp, err := NewLocalKeyProvider("k1", bytes.Repeat([]byte{1}, 32))
+	assert.NoError(t, err)
+	p := &Uploader{keys: kp}
+
+	for _, n := range []int{encryptChunkSize + 1, spoolMemoryLimit + 1} {
+		data := make([]byte, n)
+		out, meta, err := p.encryptSnapshot(context.Background(), &spooled{ReaderAt: bytes.NewReader(data), size: int64(n)}, false)
+		assert.NoError(t, err)
+		assert.NotNil(t, meta)
+		assert.Equal(t, n > spoolMemoryLimit, out.file != nil)
+		ct1, err := ioutil.ReadAll(io.NewSectionReader(out, 0, out.size))
+		assert.NoError(t, err)
+
+		// 明文在加密之后变化，再次读取得到的仍然是同一份密文
+		for i := range data {
+			data[i] = 1
+		}
+		ct2, err := ioutil.ReadAll(io.NewSectionReader(out, 0, out.size))
+		assert.NoError(t, err)
+		assert.Equal(t, ct1, ct2)
+		assert.NoError(t, out.Close())
+	}
+}
+
+// encryptTestData 按 chunkSize 加密 data，返回密文及 XMeta
+func encryptTestData(t *testing.T, kp KeyProvider, data []byte, chunkSize int64) ([]byte, map[string]string) {
+	key, wrapped, keyId, err := kp.GenerateDataKey(context.Background())
+	assert.NoError(t, err)
+	env, err := newEnvelope(key, bytes.Repeat([]byte{2}, encryptNonceSize), chunkSize)
+	assert.NoError(t, err)
+	size := int64(len(data))
+	ct, err := ioutil.ReadAll(io.NewSectionReader(&encryptReaderAt{env: env, r: bytes.NewReader(data), size: size}, 0, env.encryptedSize(size)))
+	assert.NoError(t, err)
+	return ct, env.meta(keyId, wrapped)
+}
+
+// newEncryptedServer 返回提供 data 加密后内容的范围下载服务，及可以解密的 Downloader
+func newEncryptedServer(t *testing.T, data []byte, chunkSize int64) (*rangeServer, *httptest.Server, *Downloader) {
+	kp, err := NewLocalKeyProvider("k1", bytes.Repeat([]byte{1}, 32))
+	assert.NoError(t, err)
+	rs := newRangeServer(nil)
+	rs.data, rs.meta = encryptTestData(t, kp, data, chunkSize)
+	srv := httptest.NewServer(rs)
+	d := newTestDownloader(srv.URL)
+	d.SetKeyProvider(kp)
+	return rs, srv, d
+}
+
+func TestDownloadEncryptedRange(t *testing.T) {
+	data := testData(3*encryptChunkSize + 100)
+	rs, srv, d := newEncryptedServer(t, data, encryptChunkSize)
+	defer srv.Close()
+
+	stride := int64(encryptChunkSize + encryptTagSize)
+	cases := []struct {
+		offset, size int64
+		want         []byte
+		ranges       []string
+	}{
+		{0, 10, data[:10], []string{fmt.Sprintf("bytes=0-%d", stride-1)}},
+		// 跨越块的边界
+		{encryptChunkSize - 5, 10, data[encryptChunkSize-5 : encryptChunkSize+5], []string{fmt.Sprintf("bytes=0-%d", 2*stride-1)}},
+		// 最后一块不满，猜测的范围超出文件结尾，不需要再请求
+		{2*encryptChunkSize + 1, encryptChunkSize + 99, data[2*encryptChunkSize+1:], []string{fmt.Sprintf("bytes=%d-%d", 2*stride, 4*stride-1)}},
+		// 超出文件结尾的部分被截掉
+		{3 * encryptChunkSize, 1000, data[3*encryptChunkSize:], []string{fmt.Sprintf("bytes=%d-%d", 3*stride, 4*stride-1)}},
+		// offset 为 -1 时取最后 size 字节，先请求一个字节得到文件大小
+		{-1, 150, data[len(data)-150:], []string{"bytes=0-0", fmt.Sprintf("bytes=%d-%d", 2*stride, 3*stride+100+encryptTagSize-1)}},
+		{-1, int64(len(data)) + 1, data, []string{"bytes=0-0", fmt.Sprintf("bytes=0-%d", 3*stride+100+encryptTagSize-1)}},
+	}
+	for _, c := range cases {
+		rs.mutex.Lock()
+		rs.ranges = nil
+		rs.mutex.Unlock()
+		l, b, err := d.DownloadRangeBytes("key", c.offset, c.size, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), l)
+		assert.True(t, bytes.Equal(c.want, b), "offset %d, size %d", c.offset, c.size)
+		assert.Equal(t, c.ranges, rs.ranges, "offset %d, size %d", c.offset, c.size)
+	}
+
+	_, _, err := d.DownloadRangeBytes("key", int64(len(data)), 10, nil)
+	assert.Error(t, err)
+}
+
+func TestDownloadEncryptedRangeChunkSize(t *testing.T) {
+	// 块大小与默认的不同，按 XMeta 中的块大小重新请求
+	data := testData(5000)
+	rs, srv, d := newEncryptedServer(t, data, 1000)
+	defer srv.Close()
+
+	l, b, err := d.DownloadRangeBytes("key", 1500, 1000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5000), l)
+	assert.Equal(t, data[1500:2500], b)
+	assert.Equal(t, []string{fmt.Sprintf("bytes=0-%d", encryptChunkSize+encryptTagSize-1), "bytes=1016-3047"}, rs.ranges)
+}
+
+func TestDownloadEncryptedRangePlain(t *testing.T) {
+	data := testData(3000)
+	rs := newRangeServer(data)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+	d := newTestDownloader(srv.URL)
+	kp, err := NewLocalKeyProvider("k1", bytes.Repeat([]byte{1}, 32))
+	assert.NoError(t, err)
+	d.SetKeyProvider(kp)
+
+	// 第一次发现没有加密后按原来的范围重新请求，之后不再探测
+	for i := 0; i < 2; i++ {
+		_, b, err := d.DownloadRangeBytes("key", 100, 50, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, data[100:150], b)
+	}
+	assert.Equal(t, []string{fmt.Sprintf("bytes=0-%d", encryptChunkSize+encryptTagSize-1), "bytes=100-149", "bytes=100-149"}, rs.ranges)
+
+	// 文件被覆盖为加密的内容
+	rs.mutex.Lock()
+	rs.data, rs.meta = encryptTestData(t, kp, data, encryptChunkSize)
+	rs.ranges = nil
+	rs.mutex.Unlock()
+	_, b, err := d.DownloadRangeBytes("key", 100, 50, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, data[100:150], b)
+	assert.Equal(t, []string{"bytes=100-149", fmt.Sprintf("bytes=0-%d", encryptChunkSize+encryptTagSize-1)}, rs.ranges)
+	assert.False(t, d.isPlain("key"))
+}
+
+func TestDownloadFileEncrypted(t *testing.T) {
+	data := testData(2*encryptChunkSize + 100)
+	_, srv, d := newEncryptedServer(t, data, encryptChunkSize)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// finishPart 解密下载完成的 .part
+	path := filepath.Join(dir, "file")
+	f, err := d.DownloadFile("key", path)
+	assert.NoError(t, err)
+	f.Close()
+	assertDownloaded(t, path, data)
+
+	// 从中断的密文继续下载
+	path = filepath.Join(dir, "resumed")
+	rs := srv.Config.Handler.(*rangeServer)
+	preparePart(t, path, rs.data[:1000], rs.etag)
+	f, err = d.DownloadFile("key", path)
+	assert.NoError(t, err)
+	f.Close()
+	assertDownloaded(t, path, data)
+	assert.Equal(t, []string{"bytes=1000-"}, rs.rangesWith("bytes=1000"))
+
+	// 密文被篡改时解密失败
+	rs.mutex.Lock()
+	rs.data = append([]byte{}, rs.data...)
+	rs.data[10] ^= 1
+	rs.mutex.Unlock()
+	_, err = d.DownloadFile("key", filepath.Join(dir, "bad"))
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "bad"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadFileParallelEncrypted(t *testing.T) {
+	data := testData(3*encryptChunkSize + 100)
+	rs, srv, d := newEncryptedServer(t, data, encryptChunkSize)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// PartSize 不是块大小的整数倍时按块对齐
+	path := filepath.Join(dir, "file")
+	assert.NoError(t, d.DownloadFileParallel(context.Background(), "key", path, &ParallelOptions{PartSize: encryptChunkSize + 1000, Concurrency: 2}))
+	got, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+
+	stride := int64(encryptChunkSize + encryptTagSize)
+	for _, rg := range rs.rangesWith("bytes=") {
+		if rg == "bytes=0-0" {
+			continue
+		}
+		start, _, _ := parseTestRange(rg, int64(len(rs.data)))
+		assert.Equal(t, int64(0), start%stride, rg)
+	}
+}
+
+func TestObjectReaderEncrypted(t *testing.T) {
+	data := testData(3*encryptChunkSize + 100)
+	_, srv, d := newEncryptedServer(t, data, encryptChunkSize)
+	defer srv.Close()
+
+	r, err := d.Open(context.Background(), "key")
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, int64(len(data)), r.Size())
+	r.SetReadAhead(100)
+
+	p := make([]byte, 200)
+	for _, off := range []int64{0, encryptChunkSize - 100, 2*encryptChunkSize + 7, int64(len(data)) - 200} {
+		n, err := r.ReadAt(p, off)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, n)
+		assert.True(t, bytes.Equal(data[off:off+200], p), "offset %d", off)
+	}
+	n, err := r.ReadAt(p, int64(len(data))-50)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, data[len(data)-50:], p[:n])
+}
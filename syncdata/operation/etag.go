@@ -0,0 +1,189 @@
+package operation
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+)
+
+type HashMismatchError struct {
+	Key    string
+	Local  string
+	Remote string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("hash mismatch, key: %s, local: %s, remote: %s", e.Key, e.Local, e.Remote)
+}
+
+// CheckHash 比较本地计算的 qetag 与上传返回的 hash，不一致时返回 *HashMismatchError
+func CheckHash(key, localHash string, ret *q.PutRet) error {
+	if ret == nil || ret.Hash != localHash {
+		remote := ""
+		if ret != nil {
+			remote = ret.Hash
+		}
+		return &HashMismatchError{Key: key, Local: localHash, Remote: remote}
+	}
+	return nil
+}
+
+func isHashMismatch(err error) bool {
+	_, ok := err.(*HashMismatchError)
+	return ok
+}
+
+// putAndVerify 执行一次上传，开启 Verify 时比较服务端返回的 hash 与本地计算的 qetag，
+// 不一致时返回 *HashMismatchError。对象可能已被其他上传覆盖，这里不删除，由调用方决定如何处理
+func (p *Uploader) putAndVerify(ctx context.Context, key string, ret interface{},
+	put func(ret interface{}) error, localHash func() (string, error)) error {
+
+	if !p.verify {
+		return put(ret)
+	}
+
+	var raw json.RawMessage
+	err := put(&raw)
+	if err != nil {
+		return err
+	}
+	var putRet q.PutRet
+	if len(raw) != 0 {
+		if err = json.Unmarshal(raw, &putRet); err != nil {
+			return err
+		}
+	}
+	if putRet.Hash == "" && p.lister != nil {
+		// 合成分片时服务端返回 612/614 视为成功，但不会返回 hash，需要重新查询
+		entry, err := p.lister.Stat(ctx, key)
+		if err != nil {
+			return err
+		}
+		putRet.Hash, putRet.Key = entry.Hash, key
+		if raw, err = json.Marshal(&putRet); err != nil {
+			return err
+		}
+	}
+	local, err := localHash()
+	if err != nil {
+		return err
+	}
+	err = CheckHash(key, local, &putRet)
+	if err != nil {
+		elog.Warn("upload verify failed", err)
+		return err
+	}
+	if ret == nil || len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, ret)
+}
+
+func splitParts(fsize, partSize int64) []int64 {
+	if partSize <= 0 {
+		return []int64{fsize}
+	}
+	var parts []int64
+	for fsize > partSize {
+		parts = append(parts, partSize)
+		fsize -= partSize
+	}
+	return append(parts, fsize)
+}
+
+// 本地文件与远端对象的比较结果
+type hashMatch int
+
+const (
+	hashDiffer hashMatch = iota
+	hashSame
+	hashUnknown // 远端是分片大小未知的分片上传，本地无法计算出可以比较的 hash
+)
+
+// matchRemote 比较本地文件与远端对象的内容。远端经过压缩或加密时比较 XMeta 中记录的原始内容的大小和 qetag，
+// 没有记录时返回 hashUnknown。
+func (p *Uploader) matchRemote(ctx context.Context, file string, size int64, remote kodo.ListItem) (hashMatch, error) {
+	if etag := remote.XQnMeta[metaPlainEtag]; etag != "" {
+		if remote.XQnMeta[metaPlainSize] != strconv.FormatInt(size, 10) {
+			return hashDiffer, nil
+		}
+		local, err := qetag.EtagFile(file)
+		if err != nil {
+			return hashDiffer, err
+		}
+		return hashMatchOf(local == etag), nil
+	}
+	if remote.XQnMeta[metaCompress] != "" || remote.XQnMeta[metaEncryptAlg] != "" {
+		return hashUnknown, nil
+	}
+	if size != remote.Fsize {
+		return hashDiffer, nil
+	}
+	return p.matchRemoteHash(ctx, file, remote)
+}
+
+// matchRemoteHash 比较本地文件与远端对象的 hash，调用方需要先确认大小相同。
+// 远端是未按 4M 对齐的分片上传时，按远端各分片的实际大小计算本地 etag，
+// remote.Parts 为空时通过列举获取，仍然无法得知时返回 hashUnknown，由调用方按同步方向判断。
+// 需要考虑压缩、加密时使用 matchRemote。
+func (p *Uploader) matchRemoteHash(ctx context.Context, file string, remote kodo.ListItem) (hashMatch, error) {
+	b, err := base64.URLEncoding.DecodeString(remote.Hash)
+	if err != nil || len(b) == 0 {
+		return hashDiffer, nil
+	}
+	if b[0] != 0x9e {
+		local, err := qetag.EtagFile(file)
+		if err != nil {
+			return hashDiffer, err
+		}
+		return hashMatchOf(local == remote.Hash), nil
+	}
+
+	parts := remote.Parts
+	if len(parts) == 0 && p.lister != nil {
+		parts, err = p.lister.partSizes(ctx, remote.Key)
+		if err != nil {
+			return hashDiffer, err
+		}
+	}
+	var sum int64
+	for _, size := range parts {
+		sum += size
+	}
+	if len(parts) == 0 || sum != remote.Fsize {
+		return hashUnknown, nil
+	}
+	local, err := qetag.EtagV2File(file, parts)
+	if err != nil {
+		return hashDiffer, err
+	}
+	return hashMatchOf(local == remote.Hash), nil
+}
+
+func hashMatchOf(same bool) hashMatch {
+	if same {
+		return hashSame
+	}
+	return hashDiffer
+}
+
+// matchByTime 在 hash 无法比较时按时间判断：上传时本地文件在远端上传之后没有修改过，
+// 下载时远端在本地文件修改之后没有重新上传过，即视为相同。
+// 双向同步无法判断是哪一侧发生了变化，视为不同，由 ConflictRule 决定以哪一侧为准。
+func matchByTime(direction SyncDirection, modTime time.Time, remote kodo.ListItem) bool {
+	putTime := time.Unix(0, remote.PutTime*100) // PutTime 的单位是 100 纳秒
+	switch direction {
+	case SyncUpload:
+		return !modTime.After(putTime)
+	case SyncDownload:
+		return !putTime.After(modTime)
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package operation
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/stretchr/testify/assert"
+)
+
+// failPuts 让前 n 次表单上传成功保存文件，但返回错误的 hash
+func failPuts(s *kodoServer, n int) {
+	s.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if !strings.HasPrefix(req.URL.Path, "/put/") || n == 0 {
+			return false
+		}
+		n--
+		s.reply(w, 200, q.PutRet{Hash: "FpLiADEaVoALPkdb8tJEJyRTXoe_", Key: "key"})
+		return true
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	c := s.config()
+	c.Verify, c.Retry = true, 3
+	p := NewUploader(c)
+
+	failPuts(s, 3)
+	err := p.UploadData(context.Background(), "key", testData(1000), nil)
+	if assert.IsType(t, &HashMismatchError{}, err) {
+		e := err.(*HashMismatchError)
+		assert.Equal(t, "key", e.Key)
+		assert.Equal(t, "FpLiADEaVoALPkdb8tJEJyRTXoe_", e.Remote)
+	}
+	// 每次尝试都校验失败，用完重试次数
+	assert.Len(t, s.requestsWith("POST /put/"), 3)
+}
+
+func TestVerifyRetry(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	c := s.config()
+	c.Verify, c.Retry = true, 3
+	p := NewUploader(c)
+
+	failPuts(s, 1)
+	var ret q.PutRet
+	data := testData(1000)
+	assert.NoError(t, p.UploadData(context.Background(), "key", data, &ret))
+	assert.Len(t, s.requestsWith("POST /put/"), 2)
+	assert.Equal(t, s.get("key").hash, ret.Hash)
+	assert.Equal(t, data, s.get("key").data)
+}
+
+func TestVerifyStatFallback(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	c := s.config()
+	c.Verify = true
+	p := NewUploader(c)
+
+	// 上传没有返回 hash 时通过 Stat 获取
+	s.noHash = true
+	var ret q.PutRet
+	assert.NoError(t, p.UploadData(context.Background(), "key", testData(1000), &ret))
+	assert.Equal(t, s.get("key").hash, ret.Hash)
+	assert.Equal(t, "key", ret.Key)
+	assert.Len(t, s.requestsWith("POST /stat/"), 1)
+}
+
+func TestVerifyMultipart(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	c := s.config()
+	c.Verify = true
+	p := NewUploader(c)
+
+	dir, err := ioutil.TempDir("", "verify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	data := testData(5<<19 + 123)
+	assert.NoError(t, ioutil.WriteFile(file, data, 0644))
+
+	// 分片上传按实际的分片大小计算本地 etag
+	assert.NoError(t, p.Upload(context.Background(), file, "key"))
+	assert.Equal(t, data, s.get("key").data)
+	assert.Len(t, s.get("key").parts, 3)
+}
@@ -0,0 +1,249 @@
+package operation
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+)
+
+// kodoServer 在内存中模拟存储的上传、rs、rsf 及 io 接口，文件的 hash 为真实的 qetag
+type kodoServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	objects  map[string]*kodoObject
+	parts    map[string][]byte // 分片上传的分片，以 etag 为 key
+	uploads  int
+	aborted  []string // 被删除的分片上传任务
+	requests []string // 收到的请求，格式为 "METHOD 路径"
+	noHash   bool     // 为 true 时上传成功不返回 hash
+
+	// hook 不为 nil 时先于默认处理调用，返回 true 表示已经处理了这个请求
+	hook func(w http.ResponseWriter, req *http.Request) bool
+}
+
+type kodoObject struct {
+	data    []byte
+	hash    string
+	putTime int64 // 单位为 100 纳秒
+	meta    map[string]string
+	parts   []int64 // 分片上传时各分片的大小
+}
+
+func newKodoServer() *kodoServer {
+	s := &kodoServer{objects: map[string]*kodoObject{}, parts: map[string][]byte{}}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// config 返回所有域名都指向 s 的配置
+func (s *kodoServer) config() *Config {
+	return &Config{
+		UpHosts:  []string{s.URL},
+		RsHosts:  []string{s.URL},
+		RsfHosts: []string{s.URL},
+		IoHosts:  []string{s.URL},
+		Bucket:   "bucket",
+		Ak:       "ak",
+		Sk:       "sk",
+		PartSize: 1 << 20,
+		Retry:    1,
+	}
+}
+
+// put 直接写入一个文件，putTime 为零值时使用当前时间
+func (s *kodoServer) put(key string, data []byte, meta map[string]string, putTime time.Time) {
+	if putTime.IsZero() {
+		putTime = time.Now()
+	}
+	hash, _ := qetag.Etag(bytes.NewReader(data))
+	s.mutex.Lock()
+	s.objects[key] = &kodoObject{data: data, hash: hash, putTime: putTime.UnixNano() / 100, meta: meta}
+	s.mutex.Unlock()
+}
+
+func (s *kodoServer) get(key string) *kodoObject {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.objects[key]
+}
+
+func (s *kodoServer) keys() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// requestsWith 返回以 prefix 开头的请求
+func (s *kodoServer) requestsWith(prefix string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var reqs []string
+	for _, r := range s.requests {
+		if strings.HasPrefix(r, prefix) {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+func (s *kodoServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path)
+	hook := s.hook
+	s.mutex.Unlock()
+	if hook != nil && hook(w, req) {
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	segs := strings.Split(req.URL.Path, "/")
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/getfile/"):
+		s.getfile(w, req, strings.SplitN(req.URL.Path, "/", 5)[4])
+	case strings.HasPrefix(req.URL.Path, "/put/"):
+		key, meta := "", map[string]string{}
+		for i := 3; i+1 < len(segs); i += 2 {
+			v, _ := base64.URLEncoding.DecodeString(segs[i+1])
+			if segs[i] == "key" {
+				key = string(v)
+			} else if strings.HasPrefix(segs[i], "x-qn-meta-") {
+				meta[strings.TrimPrefix(segs[i], "x-qn-meta-")] = string(v)
+			}
+		}
+		hash, _ := qetag.Etag(bytes.NewReader(body))
+		s.objects[key] = &kodoObject{data: body, hash: hash, putTime: time.Now().UnixNano() / 100, meta: meta}
+		s.putRet(w, key, hash)
+	case strings.HasPrefix(req.URL.Path, "/buckets/"): // /buckets/<bucket>/objects/<key>/uploads[/<uploadId>[/<partNum>]]
+		s.multipart(w, req, segs, body)
+	case strings.HasPrefix(req.URL.Path, "/stat/"):
+		key := s.entryKey(segs[2])
+		o, ok := s.objects[key]
+		if !ok {
+			s.reply(w, 612, map[string]string{"error": "no such file or directory"})
+			return
+		}
+		s.reply(w, 200, s.listItem(key, o, false))
+	case strings.HasPrefix(req.URL.Path, "/delete/"):
+		key := s.entryKey(segs[2])
+		if _, ok := s.objects[key]; !ok {
+			s.reply(w, 612, map[string]string{"error": "no such file or directory"})
+			return
+		}
+		delete(s.objects, key)
+		s.reply(w, 200, struct{}{})
+	case req.URL.Path == "/list":
+		prefix := req.URL.Query().Get("prefix")
+		needParts := req.URL.Query().Get("needparts") == "true"
+		var items []kodo.ListItem
+		for key, o := range s.objects {
+			if strings.HasPrefix(key, prefix) {
+				items = append(items, s.listItem(key, o, needParts))
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+		s.reply(w, 200, map[string]interface{}{"items": items})
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+func (s *kodoServer) getfile(w http.ResponseWriter, req *http.Request, key string) {
+	o, ok := s.objects[key]
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	for k, v := range o.meta {
+		w.Header().Set("X-Qn-Meta-"+k, v)
+	}
+	w.Header().Set("Etag", `"`+o.hash+`"`)
+	// ServeContent 处理 Range、If-Range 及 416
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(o.data))
+}
+
+func (s *kodoServer) multipart(w http.ResponseWriter, req *http.Request, segs []string, body []byte) {
+	rawKey, _ := base64.URLEncoding.DecodeString(segs[4])
+	key := string(rawKey)
+	switch {
+	case req.Method == "POST" && len(segs) == 6:
+		s.uploads++
+		s.reply(w, 200, map[string]string{"uploadId": fmt.Sprint("upload-", s.uploads)})
+	case req.Method == "PUT" && len(segs) == 8:
+		etag := segs[6] + "-" + segs[7]
+		s.parts[etag] = body
+		sum := md5.Sum(body)
+		s.reply(w, 200, q.UploadPartRet{Etag: etag, Md5: hex.EncodeToString(sum[:])})
+	case req.Method == "POST" && len(segs) == 7:
+		var mp q.CompleteMultipart
+		json.Unmarshal(body, &mp)
+		var data []byte
+		var sizes []int64
+		for _, part := range mp.Parts {
+			data = append(data, s.parts[part.Etag]...)
+			sizes = append(sizes, int64(len(s.parts[part.Etag])))
+		}
+		meta := map[string]string{}
+		for k, v := range mp.Metadata {
+			meta[strings.TrimPrefix(k, "x-qn-meta-")] = v
+		}
+		hash, _ := qetag.EtagV2(bytes.NewReader(data), sizes)
+		s.objects[key] = &kodoObject{data: data, hash: hash, putTime: time.Now().UnixNano() / 100, meta: meta, parts: sizes}
+		s.putRet(w, key, hash)
+	case req.Method == "DELETE" && len(segs) == 7:
+		s.aborted = append(s.aborted, segs[6])
+		s.reply(w, 200, struct{}{})
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+func (s *kodoServer) entryKey(encoded string) string {
+	entry, _ := base64.URLEncoding.DecodeString(encoded)
+	return strings.TrimPrefix(string(entry), "bucket:")
+}
+
+func (s *kodoServer) listItem(key string, o *kodoObject, needParts bool) kodo.ListItem {
+	item := kodo.ListItem{Key: key, Hash: o.hash, Fsize: int64(len(o.data)), PutTime: o.putTime}
+	if len(o.meta) != 0 {
+		item.XQnMeta = o.meta
+	}
+	if needParts {
+		item.Parts = o.parts
+	}
+	return item
+}
+
+func (s *kodoServer) putRet(w http.ResponseWriter, key, hash string) {
+	if s.noHash {
+		hash = ""
+	}
+	s.reply(w, 200, q.PutRet{Hash: hash, Key: key})
+}
+
+func (s *kodoServer) reply(w http.ResponseWriter, code int, ret interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ret)
+}
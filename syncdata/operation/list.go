@@ -37,7 +37,12 @@ type FileStat struct {
 	Size int64  `json:"size"`
 }
 
-func (l *Lister) RetryRs(f func(host string) error) (err error) {
+func (l *Lister) RetryRs(f func(host string) error) error {
+	return l.RetryRsWithContext(context.Background(), f)
+}
+
+// RetryRsWithContext 与 RetryRs 相同，重试前按指数退避等待，ctx 取消时立即返回
+func (l *Lister) RetryRsWithContext(ctx context.Context, f func(host string) error) (err error) {
 	for i := 0; i < l.retry; i++ {
 		host := l.hostPin.Unpin()
 		if host == "" {
@@ -47,6 +52,9 @@ func (l *Lister) RetryRs(f func(host string) error) (err error) {
 		if shouldRetry(err) {
 			l.rsSelector.SetPunish(host)
 			elog.Info("rs try failed. punish host", host, err, i)
+			if err1 := waitRetry(ctx, i, l.retry); err1 != nil {
+				return err1
+			}
 			continue
 		}
 		l.hostPin.Pin(host)
@@ -55,13 +63,21 @@ func (l *Lister) RetryRs(f func(host string) error) (err error) {
 	return err
 }
 
-func (l *Lister) RetryRsf(f func(host string) error) (err error) {
+func (l *Lister) RetryRsf(f func(host string) error) error {
+	return l.RetryRsfWithContext(context.Background(), f)
+}
+
+// RetryRsfWithContext 与 RetryRsf 相同，重试前按指数退避等待，ctx 取消时立即返回
+func (l *Lister) RetryRsfWithContext(ctx context.Context, f func(host string) error) (err error) {
 	for i := 0; i < l.retry; i++ {
 		host := l.rsfSelector.SelectHost()
 		err = f(host)
 		if shouldRetry(err) {
 			l.rsfSelector.SetPunish(host)
 			elog.Info("rsf try failed. punish host", host, err, i)
+			if err1 := waitRetry(ctx, i, l.retry); err1 != nil {
+				return err1
+			}
 			continue
 		}
 		break
@@ -70,34 +86,43 @@ func (l *Lister) RetryRsf(f func(host string) error) (err error) {
 }
 
 func (l *Lister) Delete(ctx context.Context, key string) (err error) {
-	l.RetryRs(func(host string) error {
+	err1 := l.RetryRsWithContext(ctx, func(host string) error {
 		bucket := l.newBucket(host, "")
 		err = bucket.Delete(ctx, key)
 		return err
 	})
+	if err1 != nil {
+		err = err1
+	}
 	return
 }
 
 func (l *Lister) BatchDelete(ctx context.Context, key ...string) (rets []kodo.BatchItemRet, err error) {
-	l.RetryRs(func(host string) error {
+	err1 := l.RetryRsWithContext(ctx, func(host string) error {
 		bucket := l.newBucket(host, "")
 		rets, err = bucket.BatchDelete(ctx, key...)
 		return err
 	})
+	if err1 != nil {
+		err = err1
+	}
 	return
 }
 
 func (l *Lister) Stat(ctx context.Context, key string) (entry kodo.Entry, err error) {
-	l.RetryRs(func(host string) error {
+	err1 := l.RetryRsWithContext(ctx, func(host string) error {
 		bucket := l.newBucket(host, "")
 		entry, err = bucket.Stat(ctx, key)
 		return err
 	})
+	if err1 != nil {
+		err = err1
+	}
 	return
 }
 
 func (l *Lister) ListPrefix(ctx context.Context, prefix, marker string, limit int) (entrys []kodo.ListItem, markerOut string, err error) {
-	l.RetryRsf(func(host string) error {
+	err1 := l.RetryRsfWithContext(ctx, func(host string) error {
 		bucket := l.newBucket("", host)
 		entrys, markerOut, err = bucket.List(ctx, prefix, marker, limit)
 		if err == io.EOF {
@@ -105,9 +130,40 @@ func (l *Lister) ListPrefix(ctx context.Context, prefix, marker string, limit in
 		}
 		return err
 	})
+	if err1 != nil {
+		err = err1
+	}
+	return
+}
+
+// ListPrefixWithParts 与 ListPrefix 相同，分片上传的文件同时返回各分片的大小
+func (l *Lister) ListPrefixWithParts(ctx context.Context, prefix, marker string, limit int) (entrys []kodo.ListItem, markerOut string, err error) {
+	err1 := l.RetryRsfWithContext(ctx, func(host string) error {
+		bucket := l.newBucket("", host)
+		entrys, markerOut, err = bucket.ListWithParts(ctx, prefix, marker, limit)
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	})
+	if err1 != nil {
+		err = err1
+	}
 	return
 }
 
+// partSizes 通过列举 key 本身获取分片上传的文件各分片的大小，文件不存在或者不是分片上传时返回 nil
+func (l *Lister) partSizes(ctx context.Context, key string) ([]int64, error) {
+	entrys, _, err := l.ListPrefixWithParts(ctx, key, "", 1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(entrys) == 0 || entrys[0].Key != key {
+		return nil, nil
+	}
+	return entrys[0].Parts, nil
+}
+
 func NewLister(c *Config) *Lister {
 	mac := qbox.NewMac(c.Ak, c.Sk)
 	var queryer *Queryer = nil
@@ -1 +1,174 @@
 package operation
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+)
+
+// 分片上传任务在服务端保留 7 天，断点记录超过 5 天直接丢弃，留出余量避免继续上传时任务过期
+const recordExpireTime = 5 * 24 * time.Hour
+
+// Recorder 用于持久化断点续传的进度
+type Recorder interface {
+	Get(key string) ([]byte, error)
+	Set(key string, data []byte) error
+	Delete(key string) error
+}
+
+type FileRecorder struct {
+	dir string
+}
+
+func NewFileRecorder(dir string) (*FileRecorder, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileRecorder{dir: dir}, nil
+}
+
+func (r *FileRecorder) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(r.dir, key))
+}
+
+func (r *FileRecorder) Set(key string, data []byte) error {
+	path := filepath.Join(r.dir, key)
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (r *FileRecorder) Delete(key string) error {
+	err := os.Remove(filepath.Join(r.dir, key))
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+type uploadRecord struct {
+	Bucket     string   `json:"bucket"`
+	Key        string   `json:"key"`
+	Fsize      int64    `json:"fsize"`
+	ModTime    int64    `json:"mod_time"`
+	UploadId   string   `json:"upload_id"`
+	PartSize   int64    `json:"part_size"`
+	Parts      []q.Part `json:"parts"`
+	CreateTime int64    `json:"create_time"`
+}
+
+func recordKey(bucket, key, file string, fInfo os.FileInfo) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%d\n%d", bucket, key, file, fInfo.Size(), fInfo.ModTime().UnixNano())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// uploadRecorder 在每个分片上传完成后将进度写入 Recorder
+type uploadRecorder struct {
+	recorder Recorder
+	key      string
+	record   uploadRecord
+	mutex    sync.Mutex
+}
+
+func newUploadRecorder(recorder Recorder, bucket, key, file string, fInfo os.FileInfo) *uploadRecorder {
+	return &uploadRecorder{
+		recorder: recorder,
+		key:      recordKey(bucket, key, file, fInfo),
+		record: uploadRecord{
+			Bucket:  bucket,
+			Key:     key,
+			Fsize:   fInfo.Size(),
+			ModTime: fInfo.ModTime().UnixNano(),
+		},
+	}
+}
+
+// load 读取之前的上传进度，记录不存在、已过期或者与当前文件不符时返回 nil
+func (r *uploadRecorder) load() *q.UploadProgress {
+	data, err := r.recorder.Get(r.key)
+	if err != nil {
+		return nil
+	}
+	var record uploadRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		elog.Warn("invalid upload record", r.key, err)
+		r.recorder.Delete(r.key)
+		return nil
+	}
+	if record.Bucket != r.record.Bucket || record.Key != r.record.Key ||
+		record.Fsize != r.record.Fsize || record.ModTime != r.record.ModTime ||
+		record.UploadId == "" || record.PartSize <= 0 ||
+		time.Since(time.Unix(record.CreateTime, 0)) > recordExpireTime {
+		r.recorder.Delete(r.key)
+		return nil
+	}
+
+	r.mutex.Lock()
+	r.record = record
+	r.mutex.Unlock()
+	parts := make([]q.Part, len(record.Parts))
+	copy(parts, record.Parts)
+	return &q.UploadProgress{UploadId: record.UploadId, Parts: parts}
+}
+
+func (r *uploadRecorder) partSize() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.record.PartSize
+}
+
+func (r *uploadRecorder) onInit(uploadId string, uploadParts []int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.record.UploadId = uploadId
+	r.record.PartSize = uploadParts[0]
+	r.record.Parts = make([]q.Part, len(uploadParts))
+	r.record.CreateTime = time.Now().Unix()
+	r.save()
+}
+
+func (r *uploadRecorder) onPart(partIdx int, etag string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if partIdx < 1 || partIdx > len(r.record.Parts) {
+		return
+	}
+	r.record.Parts[partIdx-1] = q.Part{PartNumber: partIdx, Etag: etag}
+	r.save()
+}
+
+func (r *uploadRecorder) save() {
+	data, err := json.Marshal(&r.record)
+	if err != nil {
+		return
+	}
+	err = r.recorder.Set(r.key, data)
+	if err != nil {
+		elog.Warn("save upload record failed", r.key, err)
+	}
+}
+
+func (r *uploadRecorder) delete() {
+	err := r.recorder.Delete(r.key)
+	if err != nil {
+		elog.Warn("delete upload record failed", r.key, err)
+	}
+}
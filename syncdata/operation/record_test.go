@@ -0,0 +1,46 @@
+package operation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "data")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("hello world"), 0644))
+	fInfo, err := os.Stat(file)
+	assert.NoError(t, err)
+
+	recorder, err := NewFileRecorder(filepath.Join(dir, "records"))
+	assert.NoError(t, err)
+
+	rec := newUploadRecorder(recorder, "bucket", "key", file, fInfo)
+	assert.Nil(t, rec.load())
+
+	rec.onInit("upload-id", []int64{4, 4, 3})
+	rec.onPart(2, "etag2")
+
+	rec = newUploadRecorder(recorder, "bucket", "key", file, fInfo)
+	progress := rec.load()
+	assert.NotNil(t, progress)
+	assert.Equal(t, "upload-id", progress.UploadId)
+	assert.Equal(t, int64(4), rec.partSize())
+	assert.Equal(t, 3, len(progress.Parts))
+	assert.Equal(t, "", progress.Parts[0].Etag)
+	assert.Equal(t, "etag2", progress.Parts[1].Etag)
+
+	rec = newUploadRecorder(recorder, "bucket", "key2", file, fInfo)
+	assert.Nil(t, rec.load())
+
+	rec = newUploadRecorder(recorder, "bucket", "key", file, fInfo)
+	rec.delete()
+	assert.Nil(t, rec.load())
+}
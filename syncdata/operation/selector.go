@@ -74,8 +74,9 @@ func (hs *HostSelector) setHosts(hosts []string) {
 }
 
 func (hs *HostSelector) SelectHost() string {
-	hs.mutex.RLock()
-	defer hs.mutex.RUnlock()
+	// 会修改 idx，不能只加读锁
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
 
 	if len(hs.hosts) == 0 {
 		return ""
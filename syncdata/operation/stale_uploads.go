@@ -0,0 +1,81 @@
+package operation
+
+import (
+	"context"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+)
+
+type AbortedUpload struct {
+	Key      string
+	UploadId string
+	InitTime time.Time
+	Err      error // 删除失败的原因，为 nil 表示已删除
+}
+
+func (p *Uploader) bucketUploader(ctx context.Context) (q.Uploader, string, error) {
+	policy := kodo.PutPolicy{
+		Scope:   p.bucket,
+		Expires: 3600 + uint32(time.Now().Unix()),
+	}
+	uploader := q.NewUploader(1, &q.UploadConfig{
+		Transport:    p.transport,
+		HostSelector: p.upSelector,
+	})
+	upToken, err := p.makeUptoken(ctx, &policy)
+	return uploader, upToken, err
+}
+
+// ListUploads 列举 key 以 prefix 开头的未完成的分片上传任务
+func (p *Uploader) ListUploads(ctx context.Context, prefix string) ([]q.UploadInfo, error) {
+	uploader, upToken, err := p.bucketUploader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.ListUploads(ctx, upToken, p.bucket, prefix)
+}
+
+// AbortStaleUploads 删除 key 以 prefix 开头、创建时间早于 olderThan 之前的分片上传任务，
+// 返回处理过的任务，单个任务删除失败不会中断整个过程。没有创建时间的任务会被跳过。
+func (p *Uploader) AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) ([]AbortedUpload, error) {
+	uploader, upToken, err := p.bucketUploader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := uploader.ListUploads(ctx, upToken, p.bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(-olderThan)
+	var aborted []AbortedUpload
+	for _, upload := range uploads {
+		if upload.InitTime <= 0 {
+			// 没有创建时间时无法判断是否过期，不能删除可能仍在进行的上传
+			elog.Warn("skip upload without init time", upload.Key, upload.UploadId)
+			continue
+		}
+		initTime := time.Unix(upload.InitTime, 0)
+		if !initTime.Before(deadline) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return aborted, ctx.Err()
+		}
+		err := uploader.AbortUpload(ctx, upToken, p.bucket, upload.Key, upload.UploadId)
+		if err != nil {
+			elog.Warn("abort stale upload failed", upload.Key, upload.UploadId, err)
+		} else {
+			elog.Info("abort stale upload", upload.Key, upload.UploadId, initTime)
+		}
+		aborted = append(aborted, AbortedUpload{
+			Key:      upload.Key,
+			UploadId: upload.UploadId,
+			InitTime: initTime,
+			Err:      err,
+		})
+	}
+	return aborted, nil
+}
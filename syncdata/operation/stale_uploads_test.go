@@ -0,0 +1,51 @@
+package operation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAbortStaleUploads(t *testing.T) {
+	now := time.Now().Unix()
+	uploads := []q.UploadInfo{
+		{Key: "zero", UploadId: "u0", InitTime: 0},
+		{Key: "recent", UploadId: "u1", InitTime: now - 60},
+		{Key: "old", UploadId: "u2", InitTime: now - 3*24*3600},
+	}
+	var mutex sync.Mutex
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(map[string]interface{}{"uploads": uploads})
+		case "DELETE":
+			mutex.Lock()
+			deleted = append(deleted, req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+			mutex.Unlock()
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+	defer srv.Close()
+
+	p := NewUploader(&Config{UpHosts: []string{srv.URL}, Bucket: "bucket", Ak: "ak", Sk: "sk", Retry: 1})
+	aborted, err := p.AbortStaleUploads(context.Background(), "", 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u2"}, deleted)
+	if assert.Len(t, aborted, 1) {
+		assert.Equal(t, "old", aborted[0].Key)
+		assert.Equal(t, time.Unix(now-3*24*3600, 0), aborted[0].InitTime)
+		assert.NoError(t, aborted[0].Err)
+	}
+}
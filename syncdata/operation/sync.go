@@ -0,0 +1,329 @@
+package operation
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+)
+
+type SyncDirection int
+
+const (
+	SyncUpload   SyncDirection = iota // 本地目录 -> 空间前缀
+	SyncDownload                      // 空间前缀 -> 本地目录
+	SyncBoth                          // 双向同步，只存在于一侧的文件复制到另一侧
+)
+
+// 双向同步时两侧文件都存在且内容不同（或者无法比较内容）的处理方式
+type ConflictRule int
+
+const (
+	NewerWins  ConflictRule = iota // 本地修改时间与远端上传时间较新的一方覆盖另一方
+	LocalWins                      // 以本地为准
+	RemoteWins                     // 以远端为准
+)
+
+type SyncOp string
+
+const (
+	SyncOpUpload       SyncOp = "upload"
+	SyncOpDownload     SyncOp = "download"
+	SyncOpDeleteRemote SyncOp = "delete_remote"
+	SyncOpDeleteLocal  SyncOp = "delete_local"
+)
+
+type SyncOptions struct {
+	Direction   SyncDirection
+	Conflict    ConflictRule
+	DryRun      bool // 只计算需要执行的操作，不实际执行
+	Concurrency int  // 可选。同时执行的操作数，默认为 4
+}
+
+type SyncAction struct {
+	Op   SyncOp
+	Path string
+	Key  string
+	Err  error
+}
+
+type Syncer struct {
+	uploader   *Uploader
+	downloader *Downloader
+	lister     *Lister
+	downPath   string
+	delete     bool
+}
+
+// NewSyncer 创建同步器。Config.Delete 为 true 时单向同步会删除目标端多余的文件，
+// Config.DownPath 是未指定本地目录时使用的默认目录。
+func NewSyncer(c *Config) *Syncer {
+	return &Syncer{
+		uploader:   NewUploader(c),
+		downloader: NewDownloader(c),
+		lister:     NewLister(c),
+		downPath:   c.DownPath,
+		delete:     c.Delete,
+	}
+}
+
+type localFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Sync 比较 localDir 与空间中 prefix 下的文件，按 opts 上传、下载或删除差异文件，
+// 返回所有需要执行的操作及其结果。
+func (s *Syncer) Sync(ctx context.Context, localDir, prefix string, opts *SyncOptions) ([]SyncAction, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	if localDir == "" {
+		localDir = s.downPath
+	}
+	if localDir == "" {
+		return nil, errors.New("no local directory")
+	}
+
+	locals, err := s.listLocal(localDir)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := s.listRemote(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	actions, err := s.plan(ctx, localDir, prefix, locals, remotes, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range actions {
+		elog.Info("sync", a.Op, a.Path, a.Key)
+	}
+	if opts.DryRun {
+		return actions, nil
+	}
+	s.execute(ctx, localDir, actions, opts.Concurrency)
+	removeEmptyDirs(filepath.Join(localDir, syncTmpDir))
+	return actions, nil
+}
+
+func (s *Syncer) listLocal(localDir string) (map[string]localFile, error) {
+	locals := make(map[string]localFile)
+	if _, err := os.Stat(localDir); err != nil {
+		if os.IsNotExist(err) {
+			return locals, nil
+		}
+		return nil, err
+	}
+	tmpDir := filepath.Join(localDir, syncTmpDir)
+	err := filepath.Walk(localDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && file == tmpDir {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, file)
+		if err != nil {
+			return err
+		}
+		locals[filepath.ToSlash(rel)] = localFile{path: file, size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return locals, err
+}
+
+func (s *Syncer) listRemote(ctx context.Context, prefix string) (map[string]kodo.ListItem, error) {
+	remotes := make(map[string]kodo.ListItem)
+	marker := ""
+	for {
+		items, markerOut, err := s.lister.ListPrefixWithParts(ctx, prefix, marker, 1000)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for _, item := range items {
+			rel := strings.TrimPrefix(item.Key, prefix)
+			if rel == "" || strings.HasSuffix(rel, "/") || strings.HasPrefix(rel, syncTmpDir+"/") {
+				continue
+			}
+			remotes[rel] = item
+		}
+		if err == io.EOF || markerOut == "" {
+			break
+		}
+		marker = markerOut
+	}
+	return remotes, nil
+}
+
+func (s *Syncer) plan(ctx context.Context, localDir, prefix string, locals map[string]localFile, remotes map[string]kodo.ListItem,
+	opts *SyncOptions) ([]SyncAction, error) {
+
+	var actions []SyncAction
+	add := func(op SyncOp, rel string) {
+		actions = append(actions, SyncAction{
+			Op:   op,
+			Path: filepath.Join(localDir, filepath.FromSlash(rel)),
+			Key:  prefix + rel,
+		})
+	}
+
+	for rel, local := range locals {
+		remote, ok := remotes[rel]
+		if !ok {
+			switch {
+			case opts.Direction != SyncDownload:
+				add(SyncOpUpload, rel)
+			case s.delete:
+				add(SyncOpDeleteLocal, rel)
+			}
+			continue
+		}
+		match, err := s.uploader.matchRemote(ctx, local.path, local.size, remote)
+		if err != nil {
+			return nil, err
+		}
+		if match == hashSame || match == hashUnknown && matchByTime(opts.Direction, local.modTime, remote) {
+			continue
+		}
+		switch opts.Direction {
+		case SyncUpload:
+			add(SyncOpUpload, rel)
+		case SyncDownload:
+			add(SyncOpDownload, rel)
+		default:
+			if resolveConflict(opts.Conflict, local, remote) {
+				add(SyncOpUpload, rel)
+			} else {
+				add(SyncOpDownload, rel)
+			}
+		}
+	}
+
+	for rel := range remotes {
+		if _, ok := locals[rel]; ok {
+			continue
+		}
+		switch {
+		case opts.Direction != SyncUpload:
+			add(SyncOpDownload, rel)
+		case s.delete:
+			add(SyncOpDeleteRemote, rel)
+		}
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Key < actions[j].Key
+	})
+	return actions, nil
+}
+
+// resolveConflict 返回 true 表示以本地为准
+func resolveConflict(rule ConflictRule, local localFile, remote kodo.ListItem) bool {
+	switch rule {
+	case LocalWins:
+		return true
+	case RemoteWins:
+		return false
+	default:
+		putTime := time.Unix(0, remote.PutTime*100) // PutTime 的单位是 100 纳秒
+		return !local.modTime.Before(putTime)
+	}
+}
+
+func (s *Syncer) execute(ctx context.Context, localDir string, actions []SyncAction, concurrency int) {
+	if concurrency <= 0 {
+		concurrency = defaultDirConcurrency
+	}
+	idxs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range idxs {
+				a := &actions[idx]
+				a.Err = s.do(ctx, localDir, a)
+				if a.Err != nil {
+					elog.Warn("sync failed", a.Op, a.Path, a.Key, a.Err)
+				}
+			}
+		}()
+	}
+	for i := range actions {
+		if ctx.Err() != nil {
+			actions[i].Err = ctx.Err()
+			continue
+		}
+		idxs <- i
+	}
+	close(idxs)
+	wg.Wait()
+}
+
+func (s *Syncer) do(ctx context.Context, localDir string, a *SyncAction) error {
+	switch a.Op {
+	case SyncOpUpload:
+		return s.uploader.Upload(ctx, a.Path, a.Key)
+	case SyncOpDownload:
+		return s.download(ctx, localDir, a.Key, a.Path)
+	case SyncOpDeleteRemote:
+		return s.lister.Delete(ctx, a.Key)
+	case SyncOpDeleteLocal:
+		return os.Remove(a.Path)
+	}
+	return errors.New("unknown sync op")
+}
+
+// 同步下载时的临时目录，位于本地目录的根下。同步和 UploadDir 都跳过这个目录，远端对应前缀下的文件也不参与同步
+const syncTmpDir = ".qiniu-sync.tmp"
+
+// download 先下载到临时目录中的同名文件，完成后再改名为 path，下载过程中 path 保持原来的内容。
+// 中断后再次同步时由 DownloadFile 的 .part.etag 记录和 If-Range 保证只在远端没有变化时续传。
+func (s *Syncer) download(ctx context.Context, localDir, key, path string) error {
+	rel, err := filepath.Rel(localDir, path)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(localDir, syncTmpDir, rel)
+	if err = os.MkdirAll(filepath.Dir(tmp), 0755); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	os.Remove(tmp)
+	f, err := s.downloader.DownloadFileWithContext(ctx, key, tmp)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, path)
+}
+
+// removeEmptyDirs 删除 root 及其下面的空目录，中断的下载留下的文件保留用于续传
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, file)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
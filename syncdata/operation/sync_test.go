@@ -0,0 +1,222 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync-plan")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	locals := map[string]localFile{}
+	remotes := map[string]kodo.ListItem{}
+	addLocal := func(rel string, data []byte, modTime time.Time) {
+		path := filepath.Join(dir, rel)
+		assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+		locals[rel] = localFile{path: path, size: int64(len(data)), modTime: modTime}
+	}
+	addRemote := func(rel string, data []byte, putTime time.Time) {
+		hash, err := qetag.Etag(bytes.NewReader(data))
+		assert.NoError(t, err)
+		remotes[rel] = kodo.ListItem{Key: "p/" + rel, Hash: hash, Fsize: int64(len(data)), PutTime: putTime.UnixNano() / 100}
+	}
+	addLocal("only-local", []byte("l"), now)
+	addRemote("only-remote", []byte("r"), now)
+	addLocal("same", []byte("same"), now)
+	addRemote("same", []byte("same"), now.Add(-time.Hour))
+	addLocal("local-newer", []byte("local"), now)
+	addRemote("local-newer", []byte("remote"), now.Add(-time.Hour))
+	addLocal("remote-newer", []byte("aaaa"), now.Add(-time.Hour)) // 大小相同，内容不同
+	addRemote("remote-newer", []byte("bbbb"), now)
+
+	const (
+		up   = SyncOpUpload
+		down = SyncOpDownload
+		delR = SyncOpDeleteRemote
+		delL = SyncOpDeleteLocal
+	)
+	cases := []struct {
+		direction SyncDirection
+		conflict  ConflictRule
+		delete    bool
+		want      map[string]SyncOp
+	}{
+		{SyncUpload, NewerWins, false, map[string]SyncOp{"only-local": up, "local-newer": up, "remote-newer": up}},
+		{SyncUpload, NewerWins, true, map[string]SyncOp{"only-local": up, "only-remote": delR, "local-newer": up, "remote-newer": up}},
+		{SyncDownload, NewerWins, false, map[string]SyncOp{"only-remote": down, "local-newer": down, "remote-newer": down}},
+		{SyncDownload, NewerWins, true, map[string]SyncOp{"only-local": delL, "only-remote": down, "local-newer": down, "remote-newer": down}},
+		{SyncBoth, NewerWins, false, map[string]SyncOp{"only-local": up, "only-remote": down, "local-newer": up, "remote-newer": down}},
+		{SyncBoth, NewerWins, true, map[string]SyncOp{"only-local": up, "only-remote": down, "local-newer": up, "remote-newer": down}},
+		{SyncBoth, LocalWins, false, map[string]SyncOp{"only-local": up, "only-remote": down, "local-newer": up, "remote-newer": up}},
+		{SyncBoth, RemoteWins, false, map[string]SyncOp{"only-local": up, "only-remote": down, "local-newer": down, "remote-newer": down}},
+	}
+	for _, c := range cases {
+		s := &Syncer{uploader: &Uploader{}, delete: c.delete}
+		actions, err := s.plan(context.Background(), dir, "p/", locals, remotes, &SyncOptions{Direction: c.direction, Conflict: c.conflict})
+		assert.NoError(t, err)
+		got := map[string]SyncOp{}
+		for i, a := range actions {
+			rel := a.Key[len("p/"):]
+			got[rel] = a.Op
+			assert.Equal(t, filepath.Join(dir, rel), a.Path)
+			if i > 0 {
+				assert.True(t, actions[i-1].Key < a.Key, "actions are sorted by key")
+			}
+		}
+		assert.Equal(t, c.want, got, "direction %d, conflict %d, delete %v", c.direction, c.conflict, c.delete)
+	}
+}
+
+// syncFixture 准备本地目录和远端前缀 p/，两侧各有一个独有的文件，一个相同的文件和一个内容不同的文件
+func syncFixture(t *testing.T, s *kodoServer) string {
+	dir, err := ioutil.TempDir("", "sync")
+	assert.NoError(t, err)
+	writeFiles(t, dir, map[string][]byte{
+		"local":    []byte("local"),
+		"same":     []byte("same"),
+		"sub/diff": []byte("local diff"),
+	})
+	s.put("p/remote", []byte("remote"), nil, time.Time{})
+	s.put("p/same", []byte("same"), nil, time.Time{})
+	s.put("p/sub/diff", []byte("remote diff"), nil, time.Now().Add(time.Hour))
+	return dir
+}
+
+func TestSyncDryRun(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	dir := syncFixture(t, s)
+	defer os.RemoveAll(dir)
+	c := s.config()
+	c.Delete = true
+
+	for _, direction := range []SyncDirection{SyncUpload, SyncDownload, SyncBoth} {
+		actions, err := NewSyncer(c).Sync(context.Background(), dir, "p/", &SyncOptions{Direction: direction, DryRun: true})
+		assert.NoError(t, err)
+		assert.Len(t, actions, 3)
+		for _, a := range actions {
+			assert.NoError(t, a.Err)
+		}
+	}
+	// 只有列举和比较，没有上传、下载和删除
+	assert.Empty(t, s.requestsWith("POST /put/"))
+	assert.Empty(t, s.requestsWith("POST /delete/"))
+	assert.Empty(t, s.requestsWith("GET /getfile/"))
+	assert.Equal(t, []string{"p/remote", "p/same", "p/sub/diff"}, s.keys())
+	_, err := os.Stat(filepath.Join(dir, "remote"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSyncBoth(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	dir := syncFixture(t, s)
+	defer os.RemoveAll(dir)
+
+	syncer := NewSyncer(s.config())
+	actions, err := syncer.Sync(context.Background(), dir, "p/", &SyncOptions{Direction: SyncBoth})
+	assert.NoError(t, err)
+	assert.Equal(t, []SyncAction{
+		{Op: SyncOpUpload, Path: filepath.Join(dir, "local"), Key: "p/local"},
+		{Op: SyncOpDownload, Path: filepath.Join(dir, "remote"), Key: "p/remote"},
+		{Op: SyncOpDownload, Path: filepath.Join(dir, "sub", "diff"), Key: "p/sub/diff"},
+	}, actions)
+	assert.Equal(t, []byte("local"), s.get("p/local").data)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "remote"))
+	assert.NoError(t, err)
+	assert.Equal(t, "remote", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(dir, "sub", "diff"))
+	assert.NoError(t, err)
+	assert.Equal(t, "remote diff", string(b))
+
+	// 同步之后两侧一致，再次同步没有需要执行的操作
+	actions, err = syncer.Sync(context.Background(), dir, "p/", &SyncOptions{Direction: SyncBoth})
+	assert.NoError(t, err)
+	assert.Empty(t, actions)
+}
+
+func TestSyncBothTransformed(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	dir := syncFixture(t, s)
+	defer os.RemoveAll(dir)
+
+	// 压缩后的大小和 hash 与本地文件不同，按 XMeta 中记录的原始内容比较，不会在两侧之间来回同步
+	syncer := NewSyncer(s.config())
+	assert.NoError(t, syncer.uploader.SetCompression("gzip"))
+	opts := &SyncOptions{Direction: SyncBoth, Conflict: NewerWins}
+	_, err := syncer.Sync(context.Background(), dir, "p/", opts)
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip", s.get("p/local").meta[metaCompress])
+
+	writeFiles(t, dir, map[string][]byte{"same": []byte("changed")})
+	actions, err := syncer.Sync(context.Background(), dir, "p/", opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []SyncAction{{Op: SyncOpUpload, Path: filepath.Join(dir, "same"), Key: "p/same"}}, actions)
+
+	for i := 0; i < 2; i++ {
+		actions, err = syncer.Sync(context.Background(), dir, "p/", opts)
+		assert.NoError(t, err)
+		assert.Empty(t, actions)
+	}
+}
+
+func TestSyncTmpDir(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "sync")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := s.config()
+	c.Delete = true
+	syncer := NewSyncer(c)
+
+	// 名字像续传临时文件的用户文件照常同步；临时目录中中断的下载不上传，远端对应的前缀也不删除
+	writeFiles(t, dir, map[string][]byte{
+		"foo.part":                   []byte("foo"),
+		"sub/foo.part.etag":          []byte("etag"),
+		syncTmpDir + "/a.part":       []byte("partial"),
+		syncTmpDir + "/a.part.etag":  []byte("{}"),
+		syncTmpDir + "/sub/b.part":   []byte("partial"),
+		syncTmpDir + "/sub/b.part.x": []byte("partial"),
+	})
+	s.put("p/foo.part", []byte("foo"), nil, time.Time{})
+	s.put("p/"+syncTmpDir+"/other", []byte("other"), nil, time.Time{})
+	actions, err := syncer.Sync(context.Background(), dir, "p/", &SyncOptions{Direction: SyncUpload})
+	assert.NoError(t, err)
+	assert.Equal(t, []SyncAction{{Op: SyncOpUpload, Path: filepath.Join(dir, "sub", "foo.part.etag"), Key: "p/sub/foo.part.etag"}}, actions)
+	assert.Equal(t, []string{"p/" + syncTmpDir + "/other", "p/foo.part", "p/sub/foo.part.etag"}, s.keys())
+
+	results, err := NewUploader(c).UploadDir(context.Background(), dir, "u/", nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+
+	// 下载 .part 结尾的文件，完成后临时目录中只剩下中断的下载
+	s.put("p/x.part", []byte("x"), nil, time.Time{})
+	for i := 0; i < 2; i++ {
+		actions, err = syncer.Sync(context.Background(), dir, "p/", &SyncOptions{Direction: SyncDownload})
+		assert.NoError(t, err)
+		if i == 0 {
+			assert.Equal(t, []SyncAction{{Op: SyncOpDownload, Path: filepath.Join(dir, "x.part"), Key: "p/x.part"}}, actions)
+		} else {
+			assert.Empty(t, actions)
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "x.part"))
+	assert.NoError(t, err)
+	assert.Equal(t, "x", string(b))
+	_, err = os.Stat(filepath.Join(dir, syncTmpDir, "a.part"))
+	assert.NoError(t, err)
+}
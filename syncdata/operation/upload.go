@@ -10,10 +10,13 @@ import (
 	"time"
 
 	"github.com/ldcsoftware/qiniu-go-sdk/x/bytes.v7"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
 
 	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/auth/qbox"
 	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
 	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/limit"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
 )
 
 type Uploader struct {
@@ -26,22 +29,33 @@ type Uploader struct {
 	queryer       *Queryer
 	retry         int
 	transport     http.RoundTripper
+	recorder      Recorder
+	verify        bool
+	lister        *Lister
+	upRate        *limit.RateLimit
+	uptokens      UptokenProvider
+	keys          KeyProvider
+	compressor    Compressor
 }
 
-func (p *Uploader) makeUptoken(policy *kodo.PutPolicy) string {
-	var rr = *policy
-	if rr.Expires == 0 {
-		rr.Expires = 3600 + uint32(time.Now().Unix())
-	}
-	b, _ := json.Marshal(&rr)
-	return qbox.SignWithData(p.credentials, b)
+// SetRecorder 设置断点续传的进度存储，为 nil 时不记录进度
+func (p *Uploader) SetRecorder(recorder Recorder) {
+	p.recorder = recorder
+}
+
+func (p *Uploader) Retry(uploader *q.Uploader, f func() error) error {
+	return p.RetryWithContext(context.Background(), f)
 }
 
-func (p *Uploader) Retry(uploader *q.Uploader, f func() error) (err error) {
+// RetryWithContext 与 Retry 相同，重试前按指数退避等待，ctx 取消时立即返回
+func (p *Uploader) RetryWithContext(ctx context.Context, f func() error) (err error) {
 	for i := 0; i < p.retry; i++ {
 		err = f()
-		if shouldRetry(err) {
+		if shouldRetry(err) || isHashMismatch(err) {
 			elog.Info("upload try failed. punish host", i, err)
+			if err1 := waitRetry(ctx, i, p.retry); err1 != nil {
+				return err1
+			}
 			continue
 		}
 		break
@@ -50,6 +64,9 @@ func (p *Uploader) Retry(uploader *q.Uploader, f func() error) (err error) {
 }
 
 func (p *Uploader) UploadData(ctx context.Context, key string, data []byte, ret interface{}) (err error) {
+	if p.keys != nil || p.compressor != nil {
+		return p.UploadDataReaderAt(ctx, key, &readSeekerAt{rs: bytes.NewReader(data)}, int64(len(data)), ret)
+	}
 	t := time.Now()
 	defer func() {
 		elog.Info("up time ", key, time.Now().Sub(t))
@@ -59,20 +76,31 @@ func (p *Uploader) UploadData(ctx context.Context, key string, data []byte, ret
 		Expires: 3600*24 + uint32(time.Now().Unix()),
 	}
 
-	upToken := p.makeUptoken(&policy)
+	upToken, err := p.makeUptoken(ctx, &policy)
+	if err != nil {
+		return err
+	}
 
 	var uploader = q.NewUploader(1, &q.UploadConfig{
 		UploadPartSize: p.partSize,
 		Concurrency:    p.upConcurrency,
 		Transport:      p.transport,
 		HostSelector:   p.upSelector,
+		RateLimit:      p.upRate,
 	})
-	return p.Retry(&uploader, func() error {
-		return uploader.Put2(ctx, ret, upToken, key, bytes.NewReader(data), int64(len(data)), nil)
+	return p.RetryWithContext(ctx, func() error {
+		return p.putAndVerify(ctx, key, ret, func(ret interface{}) error {
+			return uploader.Put2(ctx, ret, upToken, key, bytes.NewReader(data), int64(len(data)), nil)
+		}, func() (string, error) {
+			return qetag.Etag(bytes.NewReader(data))
+		})
 	})
 }
 
 func (p *Uploader) UploadDataReader(ctx context.Context, data io.ReadSeeker, size int, key string) (err error) {
+	if p.keys != nil || p.compressor != nil {
+		return p.UploadDataReaderAt(ctx, key, &readSeekerAt{rs: data}, int64(size), nil)
+	}
 	t := time.Now()
 	defer func() {
 		elog.Info("up time ", key, time.Now().Sub(t))
@@ -82,22 +110,33 @@ func (p *Uploader) UploadDataReader(ctx context.Context, data io.ReadSeeker, siz
 		Expires: 3600*24 + uint32(time.Now().Unix()),
 	}
 
-	upToken := p.makeUptoken(&policy)
+	upToken, err := p.makeUptoken(ctx, &policy)
+	if err != nil {
+		return err
+	}
 
 	var uploader = q.NewUploader(1, &q.UploadConfig{
 		UploadPartSize: p.partSize,
 		Concurrency:    p.upConcurrency,
 		Transport:      p.transport,
 		HostSelector:   p.upSelector,
+		RateLimit:      p.upRate,
 	})
 
-	return p.Retry(&uploader, func() error {
-		err := uploader.Put2(ctx, nil, upToken, key, ioutil.NopCloser(data), int64(size), nil)
-		if err == nil {
-			return nil
+	return p.RetryWithContext(ctx, func() error {
+		_, err := data.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
 		}
-		_, err = data.Seek(0, io.SeekStart)
-		return err
+		return p.putAndVerify(ctx, key, nil, func(ret interface{}) error {
+			return uploader.Put2(ctx, ret, upToken, key, ioutil.NopCloser(data), int64(size), nil)
+		}, func() (string, error) {
+			_, err := data.Seek(0, io.SeekStart)
+			if err != nil {
+				return "", err
+			}
+			return qetag.Etag(io.LimitReader(data, int64(size)))
+		})
 	})
 }
 
@@ -106,23 +145,45 @@ func (p *Uploader) UploadDataReaderAt(ctx context.Context, key string, data io.R
 	defer func() {
 		elog.Info("up time ", key, time.Now().Sub(t))
 	}()
+	content, meta, err := p.transform(ctx, data, size)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return p.putReaderAt(ctx, key, content, content.size, meta, ret)
+}
+
+// putReaderAt 直接上传 data，不再压缩、加密，meta 写入 XMeta
+func (p *Uploader) putReaderAt(ctx context.Context, key string, data io.ReaderAt, size int64, meta map[string]string, ret interface{}) error {
+	var extra *q.PutExtra
+	if meta != nil {
+		extra = &q.PutExtra{XMeta: meta}
+	}
 	policy := kodo.PutPolicy{
 		Scope:   p.bucket + ":" + key,
 		Expires: 3600*24 + uint32(time.Now().Unix()),
 	}
 
-	upToken := p.makeUptoken(&policy)
+	upToken, err := p.makeUptoken(ctx, &policy)
+	if err != nil {
+		return err
+	}
 
 	var uploader = q.NewUploader(1, &q.UploadConfig{
 		UploadPartSize: p.partSize,
 		Concurrency:    p.upConcurrency,
 		Transport:      p.transport,
 		HostSelector:   p.upSelector,
+		RateLimit:      p.upRate,
 	})
 
-	return p.Retry(&uploader, func() error {
-		var r io.Reader = io.NewSectionReader(data, 0, size)
-		return uploader.Put2(ctx, ret, upToken, key, ioutil.NopCloser(r), int64(size), nil)
+	return p.RetryWithContext(ctx, func() error {
+		return p.putAndVerify(ctx, key, ret, func(ret interface{}) error {
+			var r io.Reader = io.NewSectionReader(data, 0, size)
+			return uploader.Put2(ctx, ret, upToken, key, ioutil.NopCloser(r), int64(size), extra)
+		}, func() (string, error) {
+			return qetag.EtagReaderAt(data, size)
+		})
 	})
 }
 
@@ -135,7 +196,10 @@ func (p *Uploader) Upload(ctx context.Context, file string, key string) (err err
 		Scope:   p.bucket + ":" + key,
 		Expires: 3600*24 + uint32(time.Now().Unix()),
 	}
-	upToken := p.makeUptoken(&policy)
+	upToken, err := p.makeUptoken(ctx, &policy)
+	if err != nil {
+		return err
+	}
 
 	f, err := os.Open(file)
 	if err != nil {
@@ -155,20 +219,62 @@ func (p *Uploader) Upload(ctx context.Context, file string, key string) (err err
 		Concurrency:    p.upConcurrency,
 		Transport:      p.transport,
 		HostSelector:   p.upSelector,
+		RateLimit:      p.upRate,
 	})
+	uploader.UptokenSource = p.uptokenSource(&policy)
+
+	if p.keys != nil || p.compressor != nil {
+		// 压缩、加密后的内容与本地文件不同，不使用断点续传记录
+		return p.uploadTransformed(ctx, uploader, upToken, key, f, fInfo.Size())
+	}
 
 	if fInfo.Size() <= p.partSize {
-		return p.Retry(&uploader, func() error {
-			err := uploader.Put2(ctx, nil, upToken, key, ioutil.NopCloser(f), fInfo.Size(), nil)
-			if err == nil {
-				return nil
+		return p.RetryWithContext(ctx, func() error {
+			_, err := f.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
 			}
-			_, err = f.Seek(0, io.SeekStart)
-			return err
+			return p.putAndVerify(ctx, key, nil, func(ret interface{}) error {
+				return uploader.Put2(ctx, ret, upToken, key, ioutil.NopCloser(f), fInfo.Size(), nil)
+			}, func() (string, error) {
+				return qetag.EtagReaderAt(f, fInfo.Size())
+			})
 		})
 	}
 
-	return p.Retry(&uploader, func() error {
+	// 分片大小由服务端建议值决定，校验时按实际的切分方式计算 etag
+	var partSize int64
+	localHash := func() (string, error) {
+		return qetag.EtagV2ReaderAt(f, splitParts(fInfo.Size(), partSize))
+	}
+
+	if p.recorder != nil {
+		return p.RetryWithContext(ctx, func() error {
+			return p.putAndVerify(ctx, key, nil, func(ret interface{}) (err error) {
+				partSize, err = p.uploadWithRecorder(ctx, ret, &policy, upToken, key, file, f, fInfo)
+				return
+			}, localHash)
+		})
+	}
+
+	if p.verify {
+		return p.RetryWithContext(ctx, func() error {
+			return p.putAndVerify(ctx, key, nil, func(ret interface{}) error {
+				progress := &q.UploadProgress{
+					OnInit: func(uploadId string, uploadParts []int64) {
+						partSize = uploadParts[0]
+					},
+					DeleteOnError: true,
+				}
+				return uploader.UploadWithProgress(ctx, ret, upToken, key, newReaderAtNopCloser(f), fInfo.Size(), nil, nil, progress,
+					func(partIdx int, etag string) {
+						elog.Info("callback", partIdx, etag)
+					})
+			}, localHash)
+		})
+	}
+
+	return p.RetryWithContext(ctx, func() error {
 		return uploader.Upload(ctx, nil, upToken, key, newReaderAtNopCloser(f), fInfo.Size(), nil,
 			func(partIdx int, etag string) {
 				elog.Info("callback", partIdx, etag)
@@ -176,7 +282,137 @@ func (p *Uploader) Upload(ctx context.Context, file string, key string) (err err
 	})
 }
 
+// uploadTransformed 上传压缩、加密后的文件内容，压缩方式和加密信息保存在 XMeta 中
+func (p *Uploader) uploadTransformed(ctx context.Context, uploader q.Uploader, upToken, key string, f *os.File, fsize int64) error {
+	content, meta, err := p.transform(ctx, f, fsize)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	data, size := content, content.size
+	if size <= p.partSize {
+		return p.RetryWithContext(ctx, func() error {
+			return p.putAndVerify(ctx, key, nil, func(ret interface{}) error {
+				var r io.Reader = io.NewSectionReader(data, 0, size)
+				return uploader.Put2(ctx, ret, upToken, key, ioutil.NopCloser(r), size, &q.PutExtra{XMeta: meta})
+			}, func() (string, error) {
+				return qetag.EtagReaderAt(data, size)
+			})
+		})
+	}
+
+	var partSize int64
+	return p.RetryWithContext(ctx, func() error {
+		return p.putAndVerify(ctx, key, nil, func(ret interface{}) error {
+			progress := &q.UploadProgress{
+				OnInit: func(uploadId string, uploadParts []int64) {
+					partSize = uploadParts[0]
+				},
+				DeleteOnError: true,
+			}
+			mp := &q.CompleteMultipart{Metadata: meta}
+			return uploader.UploadWithProgress(ctx, ret, upToken, key, newReaderAtNopCloser(data), size, nil, mp, progress,
+				func(partIdx int, etag string) {
+					elog.Info("callback", partIdx, etag)
+				})
+		}, func() (string, error) {
+			return qetag.EtagV2ReaderAt(data, splitParts(size, partSize))
+		})
+	})
+}
+
+func (p *Uploader) uploadWithRecorder(ctx context.Context, ret interface{}, policy *kodo.PutPolicy, upToken, key, file string,
+	f *os.File, fInfo os.FileInfo) (int64, error) {
+
+	rec := newUploadRecorder(p.recorder, p.bucket, key, file, fInfo)
+	progress := rec.load()
+	resumed := progress != nil
+	partSize := p.partSize
+	if resumed {
+		partSize = rec.partSize()
+		elog.Info("resume upload", key, progress.UploadId)
+	} else {
+		progress = new(q.UploadProgress)
+	}
+	progress.OnInit = rec.onInit
+
+	var retryPolicy q.RetryPolicy
+	if resumed {
+		retryPolicy = resumedRetryPolicy{q.DefaultRetryPolicy}
+	}
+	var uploader = q.NewUploader(1, &q.UploadConfig{
+		UploadPartSize: partSize,
+		Concurrency:    p.upConcurrency,
+		Transport:      p.transport,
+		HostSelector:   p.upSelector,
+		RateLimit:      p.upRate,
+		RetryPolicy:    retryPolicy,
+	})
+	uploader.UptokenSource = p.uptokenSource(policy)
+	err := uploader.UploadWithProgress(ctx, ret, upToken, key, newReaderAtNopCloser(f), fInfo.Size(), nil, nil, progress,
+		func(partIdx int, etag string) {
+			elog.Info("callback", partIdx, etag)
+			rec.onPart(partIdx, etag)
+		})
+	if err == nil {
+		rec.delete()
+		return rec.partSize(), nil
+	}
+	if resumed && httputil.DetectCode(err) == q.NoSuchUpload {
+		// 任务不存在：可能之前已经合成成功，也可能已经过期
+		if ok, err1 := p.uploadedBefore(ctx, ret, key, file, fInfo.Size(), partSize); err1 == nil && ok {
+			rec.delete()
+			return partSize, nil
+		}
+	}
+	if resumed && (err == q.ErrInvalidPutProgress || httputil.DetectCode(err) == q.NoSuchUpload) {
+		// 之前的分片上传任务已经失效，丢弃记录重新上传
+		elog.Warn("discard upload record", key, progress.UploadId, err)
+		rec.delete()
+		return p.uploadWithRecorder(ctx, ret, policy, upToken, key, file, f, fInfo)
+	}
+	return 0, err
+}
+
+// resumedRetryPolicy 用于继续之前的分片上传任务。任务可能已经过期，合成文件时的 612 不能视为成功
+type resumedRetryPolicy struct {
+	q.RetryPolicy
+}
+
+func (r resumedRetryPolicy) Retry(op q.RetryOp, method q.UploadMethod, attempt int, err error, code int) q.RetryDecision {
+	if op == q.RetryCompleteParts && code == q.NoSuchUpload {
+		return q.RetryDecision{}
+	}
+	return r.RetryPolicy.Retry(op, method, attempt, err, code)
+}
+
+// uploadedBefore 通过 Stat 确认 key 是否已经是本地文件按 partSize 分片上传后的内容
+func (p *Uploader) uploadedBefore(ctx context.Context, ret interface{}, key, file string, size, partSize int64) (bool, error) {
+	if p.lister == nil {
+		return false, nil
+	}
+	entry, err := p.lister.Stat(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	local, err := qetag.EtagV2File(file, splitParts(size, partSize))
+	if err != nil || local != entry.Hash {
+		return false, err
+	}
+	if ret == nil {
+		return true, nil
+	}
+	b, err := json.Marshal(&q.PutRet{Hash: entry.Hash, Key: key})
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(b, ret)
+}
+
 func (p *Uploader) UploadWithDataChan(ctx context.Context, key string, concurrency int, dataCh chan q.PartData, ret interface{}, initNotify func(suggestedPartSize int64)) (err error) {
+	if p.keys != nil {
+		return errEncryptNotSupported
+	}
 	t := time.Now()
 	defer func() {
 		elog.Info("up time ", key, time.Now().Sub(t))
@@ -185,13 +421,18 @@ func (p *Uploader) UploadWithDataChan(ctx context.Context, key string, concurren
 		Scope:   p.bucket + ":" + key,
 		Expires: 3600*24 + uint32(time.Now().Unix()),
 	}
-	upToken := p.makeUptoken(&policy)
+	upToken, err := p.makeUptoken(ctx, &policy)
+	if err != nil {
+		return err
+	}
 
 	var uploader = q.NewUploader(1, &q.UploadConfig{
 		Concurrency:  concurrency,
 		Transport:    p.transport,
 		HostSelector: p.upSelector,
+		RateLimit:    p.upRate,
 	})
+	uploader.UptokenSource = p.uptokenSource(&policy)
 
 	return uploader.UploadWithDataChan(ctx, ret, upToken, key, dataCh, nil, initNotify,
 		func(partIdx int, etag string) {
@@ -215,7 +456,15 @@ func NewUploader(c *Config) *Uploader {
 		queryer:       queryer,
 		retry:         c.Retry,
 		transport:     NewTransport(c.DialTimeoutMs),
+		verify:        c.Verify,
+		upRate:        limit.NewRate(c.UpRate),
+	}
+	if c.UptokenUrl != "" {
+		p.uptokens = NewCachedUptokenProvider(NewRemoteUptokenProvider(c.UptokenUrl, p.transport), 0)
+	} else {
+		p.uptokens = NewMacUptokenProvider(mac)
 	}
+	p.lister = NewLister(c)
 	update := func() []string {
 		if p.queryer != nil {
 			return p.queryer.QueryUpHosts(false)
@@ -223,6 +472,17 @@ func NewUploader(c *Config) *Uploader {
 		return nil
 	}
 	p.upSelector = NewHostSelector(p.upHosts, update, 0, c.PunishTimeS, shouldRetry)
+	if err := p.SetCompression(c.Compression); err != nil {
+		elog.Warn("set compression failed", c.Compression, err)
+	}
+	if c.RecordDir != "" {
+		recorder, err := NewFileRecorder(c.RecordDir)
+		if err != nil {
+			elog.Warn("create file recorder failed", c.RecordDir, err)
+		} else {
+			p.recorder = recorder
+		}
+	}
 	return p
 }
 
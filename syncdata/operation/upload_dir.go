@@ -0,0 +1,152 @@
+package operation
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+)
+
+const defaultDirConcurrency = 4
+
+type UploadDirOptions struct {
+	Include     []string // 可选。只上传匹配的文件，为空表示全部
+	Exclude     []string // 可选。不上传匹配的文件，优先于 Include
+	Concurrency int      // 可选。同时上传的文件数，默认为 4
+	Force       bool     // 可选。为 true 时不检查远端是否已有相同的文件
+}
+
+type UploadDirResult struct {
+	Path    string
+	Key     string
+	Size    int64
+	Skipped bool // 远端已有大小和 hash 都相同的文件
+	Err     error
+}
+
+// matchPatterns 按 glob 匹配相对路径，不含 '/' 的 pattern 只匹配文件名
+func matchPatterns(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (opts *UploadDirOptions) selected(rel string) bool {
+	if matchPatterns(opts.Exclude, rel) {
+		return false
+	}
+	return len(opts.Include) == 0 || matchPatterns(opts.Include, rel)
+}
+
+// UploadDir 并发上传 localDir 下的所有文件，key 为 keyPrefix 加上以 '/' 分隔的相对路径。
+// 单个文件失败不会中断整个过程，每个文件的结果都在返回的列表中，按路径排序。
+// Syncer 下载用的临时目录 .qiniu-sync.tmp 不上传。
+func (p *Uploader) UploadDir(ctx context.Context, localDir, keyPrefix string, opts *UploadDirOptions) ([]UploadDirResult, error) {
+	if opts == nil {
+		opts = &UploadDirOptions{}
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultDirConcurrency
+	}
+	if _, err := os.Stat(localDir); err != nil {
+		return nil, err
+	}
+
+	var results []UploadDirResult
+	var resultsLock sync.Mutex
+	addResult := func(r UploadDirResult) {
+		resultsLock.Lock()
+		results = append(results, r)
+		resultsLock.Unlock()
+	}
+
+	type dirFile struct {
+		UploadDirResult
+		modTime time.Time
+	}
+	files := make(chan dirFile, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				r := f.UploadDirResult
+				r.Skipped, r.Err = p.uploadDirFile(ctx, r.Path, r.Key, r.Size, f.modTime, opts.Force)
+				if r.Err != nil {
+					elog.Warn("upload dir file failed", r.Path, r.Err)
+				}
+				addResult(r)
+			}
+		}()
+	}
+
+	tmpDir := filepath.Join(localDir, syncTmpDir)
+	walkErr := filepath.Walk(localDir, func(file string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			addResult(UploadDirResult{Path: file, Err: err})
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && file == tmpDir {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, file)
+		if err != nil {
+			addResult(UploadDirResult{Path: file, Err: err})
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if !opts.selected(rel) {
+			return nil
+		}
+		files <- dirFile{UploadDirResult{Path: file, Key: keyPrefix + rel, Size: info.Size()}, info.ModTime()}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Path < results[j].Path
+	})
+	return results, walkErr
+}
+
+func (p *Uploader) uploadDirFile(ctx context.Context, file, key string, size int64, modTime time.Time, force bool) (skipped bool, err error) {
+	if !force {
+		entry, err := p.lister.Stat(ctx, key)
+		if err == nil {
+			remote := kodo.ListItem{Key: key, Hash: entry.Hash, Fsize: entry.Fsize, PutTime: entry.PutTime, XQnMeta: entry.XQnMeta}
+			match, err := p.matchRemote(ctx, file, size, remote)
+			if err != nil {
+				return false, err
+			}
+			if match == hashSame || match == hashUnknown && matchByTime(SyncUpload, modTime, remote) {
+				return true, nil
+			}
+		}
+	}
+	return false, p.Upload(ctx, file, key)
+}
@@ -0,0 +1,179 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	cases := []struct {
+		pattern string
+		rel     string
+		match   bool
+	}{
+		{"*.log", "a.log", true},
+		{"*.log", "sub/dir/a.log", true}, // 不含 '/' 时只匹配文件名
+		{"*.log", "a.log.txt", false},
+		{"sub/*.log", "sub/a.log", true},
+		{"sub/*.log", "sub/dir/a.log", false}, // '*' 不匹配 '/'
+		{"sub/*.log", "a.log", false},
+		{"*/a.log", "sub/a.log", true},
+		{"a?c", "dir/abc", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchPatterns([]string{c.pattern}, c.rel), "%s %s", c.pattern, c.rel)
+	}
+
+	opts := &UploadDirOptions{Include: []string{"*.txt", "sub/*"}, Exclude: []string{"secret*"}}
+	assert.True(t, opts.selected("a.txt"))
+	assert.True(t, opts.selected("sub/a.bin"))
+	assert.False(t, opts.selected("a.bin"))
+	assert.False(t, opts.selected("sub/secret.txt")) // Exclude 优先
+	assert.True(t, (&UploadDirOptions{}).selected("any/file"))
+}
+
+// writeFiles 在 dir 下创建文件，files 的 key 为以 '/' 分隔的相对路径
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	for rel, data := range files {
+		file := filepath.Join(dir, filepath.FromSlash(rel))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.NoError(t, ioutil.WriteFile(file, data, 0644))
+	}
+}
+
+func TestUploadDir(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	p := NewUploader(s.config())
+	dir, err := ioutil.TempDir("", "upload-dir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string][]byte{
+		"a.txt":         []byte("a"),
+		"sub/b.txt":     []byte("b"),
+		"sub/deep/c.go": []byte("c"),
+		"sub/d.log":     []byte("d"),
+		"bad.txt":       []byte("bad"),
+	})
+
+	// bad.txt 上传失败，不影响其他文件
+	badKey := base64.URLEncoding.EncodeToString([]byte("prefix/bad.txt"))
+	s.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if strings.HasPrefix(req.URL.Path, "/put/") && strings.HasSuffix(req.URL.Path, "/key/"+badKey) {
+			s.reply(w, 400, map[string]string{"error": "bad request"})
+			return true
+		}
+		return false
+	}
+	results, err := p.UploadDir(context.Background(), dir, "prefix/", &UploadDirOptions{Exclude: []string{"*.log"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefix/a.txt", "prefix/sub/b.txt", "prefix/sub/deep/c.go"}, s.keys())
+	assert.Equal(t, []byte("c"), s.get("prefix/sub/deep/c.go").data)
+
+	if assert.Len(t, results, 4) {
+		for i, rel := range []string{"a.txt", "bad.txt", "sub/b.txt", "sub/deep/c.go"} {
+			assert.Equal(t, filepath.Join(dir, filepath.FromSlash(rel)), results[i].Path)
+			assert.Equal(t, "prefix/"+rel, results[i].Key)
+			assert.False(t, results[i].Skipped)
+		}
+		assert.Error(t, results[1].Err)
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, int64(3), results[1].Size)
+	}
+}
+
+func TestUploadDirSkip(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	p := NewUploader(s.config())
+	dir, err := ioutil.TempDir("", "upload-dir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string][]byte{
+		"same":     []byte("same"),
+		"changed":  []byte("new!"),
+		"force":    []byte("force"),
+		"v2-old":   testData(2000),
+		"v2-newer": testData(2000),
+	})
+	s.put("same", []byte("same"), nil, time.Time{})
+	s.put("changed", []byte("old!"), nil, time.Time{})
+	s.put("force", []byte("force"), nil, time.Time{})
+
+	// 分片大小未知的分片上传无法比较 hash，本地文件在远端上传之后没有修改过即视为相同
+	v2Hash, err := qetag.EtagV2(bytes.NewReader(testData(2000)), []int64{1000, 1000})
+	assert.NoError(t, err)
+	now := time.Now()
+	for key, putTime := range map[string]time.Time{"v2-old": now.Add(time.Hour), "v2-newer": now.Add(-time.Hour)} {
+		s.objects[key] = &kodoObject{data: testData(2000), hash: v2Hash, putTime: putTime.UnixNano() / 100}
+	}
+
+	results, err := p.UploadDir(context.Background(), dir, "", &UploadDirOptions{Exclude: []string{"force"}})
+	assert.NoError(t, err)
+	skipped := map[string]bool{}
+	for _, r := range results {
+		assert.NoError(t, r.Err)
+		skipped[r.Key] = r.Skipped
+	}
+	assert.Equal(t, map[string]bool{"same": true, "changed": false, "v2-old": true, "v2-newer": false}, skipped)
+	assert.Equal(t, []byte("new!"), s.get("changed").data)
+
+	// Force 时不查询远端
+	stats := len(s.requestsWith("POST /stat/"))
+	results, err = p.UploadDir(context.Background(), dir, "", &UploadDirOptions{Include: []string{"force"}, Force: true})
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.False(t, results[0].Skipped)
+	}
+	assert.Len(t, s.requestsWith("POST /stat/"), stats)
+}
+
+func TestUploadDirSkipTransformed(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "upload-dir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string][]byte{"a": testData(1000), "b": testData(3 << 19)})
+
+	kp, err := NewLocalKeyProvider("key-id", make([]byte, 32))
+	assert.NoError(t, err)
+	compressed, encrypted := NewUploader(s.config()), NewUploader(s.config())
+	assert.NoError(t, compressed.SetCompression("gzip"))
+	encrypted.SetKeyProvider(kp)
+
+	// 远端保存的是处理后的内容，按 XMeta 中记录的原始内容比较
+	for name, p := range map[string]*Uploader{"compressed/": compressed, "encrypted/": encrypted} {
+		_, err := p.UploadDir(context.Background(), dir, name, nil)
+		assert.NoError(t, err)
+		assert.NotEqual(t, testData(1000), s.get(name+"a").data, name)
+		assert.Equal(t, "1000", s.get(name + "a").meta[metaPlainSize], name)
+
+		results, err := p.UploadDir(context.Background(), dir, name, nil)
+		assert.NoError(t, err)
+		for _, r := range results {
+			assert.NoError(t, r.Err)
+			assert.True(t, r.Skipped, r.Key)
+		}
+	}
+
+	// 原始内容变化后重新上传
+	writeFiles(t, dir, map[string][]byte{"a": testData(999)})
+	results, err := compressed.UploadDir(context.Background(), dir, "compressed/", nil)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 2) {
+		assert.False(t, results[0].Skipped)
+		assert.True(t, results[1].Skipped)
+	}
+}
@@ -0,0 +1,120 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/qetag"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
+)
+
+// 条件上传时文件的当前状态不满足 Conditions
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Conditions 是覆盖上传的前提条件，对应上传策略的 Cond，零值的字段不检查。
+// 全部字段都为零值时无条件覆盖。
+type Conditions struct {
+	Hash     string // 文件当前的 hash（etag）
+	Mime     string // 文件当前的 MimeType
+	Fsize    int64  // 文件当前的大小
+	HasFsize bool   // 为 true 时即使 Fsize 为 0 也检查大小，用于要求文件当前为空
+	PutTime  int64  // 文件当前的上传时间，单位为 100 纳秒
+	NotExist bool   // 仅当文件不存在时上传，不能与其他条件同时使用
+}
+
+func (c *Conditions) cond() string {
+	var conds []string
+	if c.Hash != "" {
+		conds = append(conds, "hash="+c.Hash)
+	}
+	if c.Mime != "" {
+		conds = append(conds, "mime="+c.Mime)
+	}
+	if c.Fsize != 0 || c.HasFsize {
+		conds = append(conds, "fsize="+strconv.FormatInt(c.Fsize, 10))
+	}
+	if c.PutTime != 0 {
+		conds = append(conds, "putTime="+strconv.FormatInt(c.PutTime, 10))
+	}
+	return strings.Join(conds, "&")
+}
+
+// 条件不满足时服务端返回 412；InsertOnly 时文件已存在返回 614
+func isPreconditionFailed(err error) bool {
+	code := httputil.DetectCode(err)
+	return code == 412 || code == 614
+}
+
+// UploadIf 在 key 的当前状态满足 cond 时用 data 覆盖它，否则返回 ErrPreconditionFailed，
+// 可以用来实现乐观锁：上传成功后 data 的 qetag 就是下一次上传的 Conditions.Hash。
+// 开启压缩或加密时文件的 hash 是处理后内容的 qetag，需要通过 Stat 获取。
+func (p *Uploader) UploadIf(ctx context.Context, key string, data []byte, cond Conditions) error {
+	if cond.NotExist && cond.cond() != "" {
+		return errors.New("upload if: NotExist can't be used with other conditions")
+	}
+	t := time.Now()
+	defer func() {
+		elog.Info("up time ", key, time.Now().Sub(t))
+	}()
+	policy := kodo.PutPolicy{
+		Scope:   p.bucket + ":" + key,
+		Expires: 3600*24 + uint32(time.Now().Unix()),
+		Cond:    cond.cond(),
+	}
+	if cond.NotExist {
+		policy.Scope = p.bucket
+		policy.InsertOnly = 1
+	}
+	if err := (*q.PutPolicy)(&policy).Validate(); err != nil {
+		return err
+	}
+
+	upToken, err := p.makeUptoken(ctx, &policy)
+	if err != nil {
+		return err
+	}
+
+	var uploader = q.NewUploader(1, &q.UploadConfig{
+		Transport:    p.transport,
+		HostSelector: p.upSelector,
+		RateLimit:    p.upRate,
+	})
+	content, meta, err := p.transform(ctx, &readSeekerAt{rs: bytes.NewReader(data)}, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	size := content.size
+	var extra *q.PutExtra
+	if meta != nil {
+		extra = &q.PutExtra{XMeta: meta}
+	}
+	attempts := 0
+	err = p.RetryWithContext(ctx, func() error {
+		attempts++
+		return p.putAndVerify(ctx, key, nil, func(ret interface{}) error {
+			return uploader.Put2(ctx, ret, upToken, key, io.NewSectionReader(content, 0, size), size, extra)
+		}, func() (string, error) {
+			return qetag.EtagReaderAt(content, size)
+		})
+	})
+	if err == nil || !isPreconditionFailed(err) {
+		return err
+	}
+	if attempts > 1 && p.lister != nil {
+		// 之前失败的尝试可能已经上传成功，此时文件的 hash 与上传的内容一致
+		local, err1 := qetag.EtagReaderAt(content, size)
+		entry, err2 := p.lister.Stat(ctx, key)
+		if err1 == nil && err2 == nil && entry.Hash == local {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
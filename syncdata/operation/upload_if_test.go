@@ -0,0 +1,138 @@
+package operation
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditionsCond(t *testing.T) {
+	cases := []struct {
+		cond Conditions
+		want string
+	}{
+		{Conditions{}, ""},
+		{Conditions{Fsize: 0}, ""},
+		{Conditions{HasFsize: true}, "fsize=0"},
+		{Conditions{Fsize: 10}, "fsize=10"},
+		{Conditions{Hash: "h", Mime: "text/plain", Fsize: 10, PutTime: 5}, "hash=h&mime=text/plain&fsize=10&putTime=5"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, c.cond.cond(), c.cond)
+	}
+}
+
+// condHook 模拟服务端对上传策略中 Cond、InsertOnly 的检查，只支持 hash 和 fsize 条件。
+// conds 记录每次表单上传的 Cond
+func condHook(s *kodoServer, conds *[]string) func(w http.ResponseWriter, req *http.Request) bool {
+	return func(w http.ResponseWriter, req *http.Request) bool {
+		if !strings.HasPrefix(req.URL.Path, "/put/") {
+			return false
+		}
+		policy, err := q.ParseUptoken(strings.TrimPrefix(req.Header.Get("Authorization"), "UpToken "))
+		if err != nil {
+			s.reply(w, 401, map[string]string{"error": "bad token"})
+			return true
+		}
+		*conds = append(*conds, policy.Cond)
+		segs := strings.Split(req.URL.Path, "/")
+		key, _ := base64.URLEncoding.DecodeString(segs[len(segs)-1])
+		o := s.get(string(key))
+		if policy.InsertOnly != 0 && o != nil {
+			s.reply(w, 614, map[string]string{"error": "file exists"})
+			return true
+		}
+		if policy.Cond == "" {
+			return false
+		}
+		for _, c := range strings.Split(policy.Cond, "&") {
+			kv := strings.SplitN(c, "=", 2)
+			if o == nil || kv[0] == "hash" && kv[1] != o.hash || kv[0] == "fsize" && kv[1] != fmt.Sprint(len(o.data)) {
+				s.reply(w, 412, map[string]string{"error": "precondition failed"})
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestUploadIf(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	var conds []string
+	s.hook = condHook(s, &conds)
+	p := NewUploader(s.config())
+	ctx := context.Background()
+
+	// 不存在时才上传，已存在时服务端返回 614
+	assert.NoError(t, p.UploadIf(ctx, "key", []byte("v1"), Conditions{NotExist: true}))
+	assert.Equal(t, ErrPreconditionFailed, p.UploadIf(ctx, "key", []byte("v2"), Conditions{NotExist: true}))
+	assert.Equal(t, []byte("v1"), s.get("key").data)
+
+	// 乐观锁：hash 不是当前的 hash 时服务端返回 412
+	hash := s.get("key").hash
+	assert.NoError(t, p.UploadIf(ctx, "key", []byte("v2"), Conditions{Hash: hash}))
+	assert.Equal(t, ErrPreconditionFailed, p.UploadIf(ctx, "key", []byte("v3"), Conditions{Hash: hash}))
+	assert.Equal(t, []byte("v2"), s.get("key").data)
+
+	// HasFsize 要求文件当前为空，Fsize 为 0 而 HasFsize 为 false 时不检查大小
+	s.put("empty", nil, nil, time.Time{})
+	assert.NoError(t, p.UploadIf(ctx, "empty", []byte("data"), Conditions{HasFsize: true}))
+	assert.Equal(t, ErrPreconditionFailed, p.UploadIf(ctx, "empty", []byte("more"), Conditions{HasFsize: true}))
+	assert.NoError(t, p.UploadIf(ctx, "empty", []byte("more"), Conditions{}))
+	assert.Equal(t, []byte("more"), s.get("empty").data)
+
+	assert.Equal(t, []string{"", "", "hash=" + hash, "hash=" + hash, "fsize=0", "fsize=0", ""}, conds)
+	// 条件不满足不重试
+	assert.Len(t, s.requestsWith("POST /put/"), 7)
+}
+
+func TestUploadIfRetried(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	c := s.config()
+	c.Retry = 2
+	p := NewUploader(c)
+	ctx := context.Background()
+
+	// lost 不为 nil 时下一次上传返回 503，并用上传的内容调用 lost 模拟响应丢失前服务端的状态变化
+	var conds []string
+	var lost func(body []byte)
+	check := condHook(s, &conds)
+	s.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if strings.HasPrefix(req.URL.Path, "/put/") && lost != nil {
+			body, _ := ioutil.ReadAll(req.Body)
+			lost(body)
+			lost = nil
+			s.reply(w, 503, map[string]string{"error": "service unavailable"})
+			return true
+		}
+		return check(w, req)
+	}
+
+	// 第一次上传成功但响应丢失，重试时 hash 已经变化，通过 Stat 确认是自己上传的内容
+	s.put("key", []byte("v1"), nil, time.Time{})
+	lost = func(body []byte) { s.put("key", body, nil, time.Time{}) }
+	assert.NoError(t, p.UploadIf(ctx, "key", []byte("v2"), Conditions{Hash: s.get("key").hash}))
+	assert.Equal(t, []byte("v2"), s.get("key").data)
+	assert.Len(t, s.requestsWith("POST /put/"), 2)
+	assert.Len(t, s.requestsWith("POST /stat/"), 1)
+
+	// 第一次尝试失败期间文件被其他人修改
+	lost = func([]byte) { s.put("key", []byte("other"), nil, time.Time{}) }
+	assert.Equal(t, ErrPreconditionFailed, p.UploadIf(ctx, "key", []byte("v3"), Conditions{Hash: s.get("key").hash}))
+	assert.Equal(t, []byte("other"), s.get("key").data)
+	assert.Len(t, s.requestsWith("POST /stat/"), 2)
+
+	// 只尝试了一次时不需要 Stat
+	assert.Equal(t, ErrPreconditionFailed, p.UploadIf(ctx, "key", []byte("v4"), Conditions{NotExist: true}))
+	assert.Len(t, s.requestsWith("POST /stat/"), 2)
+}
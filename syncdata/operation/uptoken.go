@@ -0,0 +1,166 @@
+package operation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/auth/qbox"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/ldcsoftware/qiniu-go-sdk/x/rpc.v7"
+)
+
+// 上传凭证的默认有效期
+const defaultUptokenExpires = 3600 * 24
+
+// 缓存的上传凭证剩余有效期不足该值时重新获取
+const defaultUptokenRefreshBefore = 30 * time.Minute
+
+var errEmptyUptoken = errors.New("empty uptoken")
+
+// UptokenProvider 为上传策略签发上传凭证，policy.Expires 为 0 时由实现决定有效期
+type UptokenProvider interface {
+	Uptoken(ctx context.Context, policy *kodo.PutPolicy) (string, error)
+}
+
+// ---------------------------------------------------
+
+type macUptokenProvider struct {
+	mac *qbox.Mac
+}
+
+// NewMacUptokenProvider 使用 AK/SK 在本地签发上传凭证，默认有效期为 24 小时
+func NewMacUptokenProvider(mac *qbox.Mac) UptokenProvider {
+	return &macUptokenProvider{mac: mac}
+}
+
+func (p *macUptokenProvider) Uptoken(ctx context.Context, policy *kodo.PutPolicy) (string, error) {
+	var rr = *policy
+	if rr.Expires == 0 {
+		rr.Expires = defaultUptokenExpires + uint32(time.Now().Unix())
+	}
+	b, err := json.Marshal(&rr)
+	if err != nil {
+		return "", err
+	}
+	return qbox.SignWithData(p.mac, b), nil
+}
+
+// ---------------------------------------------------
+
+type remoteUptokenProvider struct {
+	url    string
+	client rpc.Client
+}
+
+// NewRemoteUptokenProvider 向上传凭证服务请求上传凭证，上传的机器不需要持有 SK。
+// 请求为 POST url，内容是 JSON 格式的上传策略；返回内容为 {"uptoken": "<UpToken>"}。
+func NewRemoteUptokenProvider(url string, transport http.RoundTripper) UptokenProvider {
+	return &remoteUptokenProvider{
+		url:    url,
+		client: rpc.Client{Client: &http.Client{Transport: transport, Timeout: time.Minute}},
+	}
+}
+
+func (p *remoteUptokenProvider) Uptoken(ctx context.Context, policy *kodo.PutPolicy) (string, error) {
+	var ret struct {
+		Uptoken string `json:"uptoken"`
+	}
+	err := p.client.CallWithJson(ctx, &ret, "POST", p.url, policy)
+	if err != nil {
+		return "", err
+	}
+	if ret.Uptoken == "" {
+		return "", errEmptyUptoken
+	}
+	return ret.Uptoken, nil
+}
+
+// ---------------------------------------------------
+
+const maxCachedUptokens = 1024
+
+type cachedUptoken struct {
+	uptoken  string
+	deadline time.Time
+}
+
+type cachedUptokenProvider struct {
+	provider      UptokenProvider
+	refreshBefore time.Duration
+	mutex         sync.Mutex
+	cache         map[string]cachedUptoken
+}
+
+// NewCachedUptokenProvider 按上传策略（不含 Expires）缓存 provider 签发的上传凭证，
+// 剩余有效期不足 refreshBefore 时重新获取。refreshBefore 为 0 时使用 30 分钟。
+func NewCachedUptokenProvider(provider UptokenProvider, refreshBefore time.Duration) UptokenProvider {
+	if refreshBefore <= 0 {
+		refreshBefore = defaultUptokenRefreshBefore
+	}
+	return &cachedUptokenProvider{
+		provider:      provider,
+		refreshBefore: refreshBefore,
+		cache:         make(map[string]cachedUptoken),
+	}
+}
+
+func (p *cachedUptokenProvider) Uptoken(ctx context.Context, policy *kodo.PutPolicy) (string, error) {
+	var rr = *policy
+	rr.Expires = 0
+	b, err := json.Marshal(&rr)
+	if err != nil {
+		return "", err
+	}
+	cacheKey := string(b)
+
+	now := time.Now()
+	p.mutex.Lock()
+	c, ok := p.cache[cacheKey]
+	p.mutex.Unlock()
+	if ok && c.deadline.Sub(now) > p.refreshBefore {
+		return c.uptoken, nil
+	}
+
+	uptoken, err := p.provider.Uptoken(ctx, policy)
+	if err != nil {
+		return "", err
+	}
+	parsed, err := q.ParseUptoken(uptoken)
+	if err != nil {
+		// 无法得知有效期，不缓存
+		return uptoken, nil
+	}
+
+	p.mutex.Lock()
+	if len(p.cache) >= maxCachedUptokens {
+		p.cache = make(map[string]cachedUptoken)
+	}
+	p.cache[cacheKey] = cachedUptoken{uptoken: uptoken, deadline: time.Unix(int64(parsed.Expires), 0)}
+	p.mutex.Unlock()
+	return uptoken, nil
+}
+
+// ---------------------------------------------------
+
+// SetUptokenProvider 设置上传凭证的来源，默认使用 Config 中的 AK/SK 在本地签发
+func (p *Uploader) SetUptokenProvider(provider UptokenProvider) {
+	p.uptokens = provider
+}
+
+func (p *Uploader) makeUptoken(ctx context.Context, policy *kodo.PutPolicy) (string, error) {
+	return p.uptokens.Uptoken(ctx, policy)
+}
+
+// uptokenSource 用于分片上传中刷新临近过期的上传凭证，新凭证的有效期重新计算
+func (p *Uploader) uptokenSource(policy *kodo.PutPolicy) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		var rr = *policy
+		rr.Expires = defaultUptokenExpires + uint32(time.Now().Unix())
+		return p.makeUptoken(ctx, &rr)
+	}
+}
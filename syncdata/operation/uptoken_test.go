@@ -0,0 +1,64 @@
+package operation
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/auth/qbox"
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingProvider struct {
+	UptokenProvider
+	n int
+}
+
+func (p *countingProvider) Uptoken(ctx context.Context, policy *kodo.PutPolicy) (string, error) {
+	p.n++
+	return p.UptokenProvider.Uptoken(ctx, policy)
+}
+
+func TestCachedUptokenProvider(t *testing.T) {
+	mac := qbox.NewMac("ak", "sk")
+	counter := &countingProvider{UptokenProvider: NewMacUptokenProvider(mac)}
+	p := NewCachedUptokenProvider(counter, time.Minute)
+	ctx := context.Background()
+
+	token1, err := p.Uptoken(ctx, &kodo.PutPolicy{Scope: "bucket:a"})
+	assert.NoError(t, err)
+	_, err = q.VerifyUptoken(mac, token1)
+	assert.NoError(t, err)
+
+	token2, err := p.Uptoken(ctx, &kodo.PutPolicy{Scope: "bucket:a", Expires: uint32(time.Now().Unix() + 100)})
+	assert.NoError(t, err)
+	assert.Equal(t, token1, token2)
+	assert.Equal(t, 1, counter.n)
+
+	_, err = p.Uptoken(ctx, &kodo.PutPolicy{Scope: "bucket:b"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counter.n)
+
+	// 剩余有效期不足 refreshBefore 时重新获取
+	policy := &kodo.PutPolicy{Scope: "bucket:c", Expires: uint32(time.Now().Unix() + 30)}
+	p.Uptoken(ctx, policy)
+	p.Uptoken(ctx, policy)
+	assert.Equal(t, 4, counter.n)
+}
+
+func TestCachedUptokenProviderLimit(t *testing.T) {
+	counter := &countingProvider{UptokenProvider: NewMacUptokenProvider(qbox.NewMac("ak", "sk"))}
+	p := NewCachedUptokenProvider(counter, time.Minute).(*cachedUptokenProvider)
+	ctx := context.Background()
+
+	// 凭证都没有临近过期，缓存满了也不会超过上限
+	for i := 0; i < maxCachedUptokens+10; i++ {
+		_, err := p.Uptoken(ctx, &kodo.PutPolicy{Scope: fmt.Sprint("bucket:", i)})
+		assert.NoError(t, err)
+		assert.True(t, len(p.cache) <= maxCachedUptokens)
+	}
+	assert.Equal(t, maxCachedUptokens+10, counter.n)
+}
@@ -67,13 +67,21 @@ func NewUserCenterV2() *UserCenter {
 	return NewUserCenter(c)
 }
 
-func (u *UserCenter) Retry(f func(host string) error) (err error) {
+func (u *UserCenter) Retry(f func(host string) error) error {
+	return u.RetryWithContext(context.Background(), f)
+}
+
+// RetryWithContext 与 Retry 相同，重试前按指数退避等待，ctx 取消时立即返回
+func (u *UserCenter) RetryWithContext(ctx context.Context, f func(host string) error) (err error) {
 	for i := 0; i < u.retry; i++ {
 		host := u.ucSelector.SelectHost()
 		err = f(host)
 		if shouldRetry(err) {
 			u.ucSelector.SetPunish(host)
 			elog.Info("uc try failed. punish host", host, i, err)
+			if err1 := waitRetry(ctx, i, u.retry); err1 != nil {
+				return err1
+			}
 			continue
 		}
 		break
@@ -82,10 +90,13 @@ func (u *UserCenter) Retry(f func(host string) error) (err error) {
 }
 
 func (d *UserCenter) GetBucketQuota(ctx context.Context) (stats BucketQuota, err error) {
-	d.Retry(func(host string) error {
+	err1 := d.RetryWithContext(ctx, func(host string) error {
 		stats, err = d.getBucketQuota(ctx, host)
 		return err
 	})
+	if err1 != nil {
+		err = err1
+	}
 	return
 }
 
@@ -96,10 +107,13 @@ func (u *UserCenter) getBucketQuota(ctx context.Context, host string) (stats Buc
 }
 
 func (u *UserCenter) GetBucketUsage(ctx context.Context) (stats FileStorageRet, err error) {
-	u.Retry(func(host string) error {
+	err1 := u.RetryWithContext(ctx, func(host string) error {
 		stats, err = u.getBucketUsage(ctx, host)
 		return err
 	})
+	if err1 != nil {
+		err = err1
+	}
 	return
 }
 
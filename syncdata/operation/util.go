@@ -1,13 +1,25 @@
 package operation
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"time"
 
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/backoff"
 	"github.com/ldcsoftware/qiniu-go-sdk/x/httputil.v1"
 )
 
+var retryBackoff = backoff.Backoff{Base: 200 * time.Millisecond, Max: 5 * time.Second}
+
+// waitRetry 在第 i 次（从 0 开始）尝试失败后等待退避时间，最后一次尝试之后不等待
+func waitRetry(ctx context.Context, i, retry int) error {
+	if i+1 >= retry {
+		return nil
+	}
+	return retryBackoff.Wait(ctx, i+1)
+}
+
 func shouldRetry(err error) bool {
 	if err == nil {
 		return false
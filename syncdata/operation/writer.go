@@ -0,0 +1,259 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodo"
+	q "github.com/ldcsoftware/qiniu-go-sdk/api.v8/kodocli"
+)
+
+const defaultWriterPartSize = 8 << 20
+
+var errWriterClosed = errors.New("upload writer closed")
+
+type WriterOptions struct {
+	PartSize int64 // 可选。分片大小，默认为 Config.PartSize
+	Buffers  int   // 可选。分片缓冲的个数，全部在上传时 Write 会阻塞，默认为上传并发数 + 1
+}
+
+// UploadWriter 把写入的数据按分片并发上传，Close 时合成文件，CloseWithError 时放弃上传。
+// 设置了压缩时先按流压缩再分片，压缩方式记录在 XMeta 中。不支持加密。
+// 不能并发调用 Write。
+type UploadWriter struct {
+	p        *Uploader
+	ctx      context.Context
+	cancel   context.CancelFunc
+	key      string
+	policy   kodo.PutPolicy
+	uploader q.Uploader
+	partSize int64
+	meta     map[string]string
+	cw       io.WriteCloser // 设置了压缩时，Write 的数据经过 cw 压缩后写入分片缓冲
+
+	free      chan []byte
+	allocated int
+	buf       []byte
+	dataCh    chan q.PartData
+	started   bool
+	done      chan struct{}
+	err       error // 分片上传的结果，done 关闭后有效
+	closeErr  error
+}
+
+// NewWriter 创建一个上传 key 的 UploadWriter，不需要预先知道数据的大小。
+// （压缩后的）数据不足一个分片时 Close 直接上传，否则使用分片上传（v2），两种方式保存的内容相同。
+func (p *Uploader) NewWriter(ctx context.Context, key string, opts *WriterOptions) *UploadWriter {
+	if opts == nil {
+		opts = &WriterOptions{}
+	}
+	partSize := opts.PartSize
+	if partSize <= 0 {
+		partSize = p.partSize
+	}
+	if partSize <= 0 {
+		partSize = defaultWriterPartSize
+	}
+	concurrency := p.upConcurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	buffers := opts.Buffers
+	if buffers <= 0 {
+		buffers = concurrency + 1
+	}
+
+	policy := kodo.PutPolicy{
+		Scope:   p.bucket + ":" + key,
+		Expires: 3600*24 + uint32(time.Now().Unix()),
+	}
+	uploader := q.NewUploader(1, &q.UploadConfig{
+		Concurrency:  concurrency,
+		Transport:    p.transport,
+		HostSelector: p.upSelector,
+		RateLimit:    p.upRate,
+	})
+	uploader.UptokenSource = p.uptokenSource(&policy)
+	ctx, cancel := context.WithCancel(ctx)
+	w := &UploadWriter{
+		p:        p,
+		ctx:      ctx,
+		cancel:   cancel,
+		key:      key,
+		policy:   policy,
+		uploader: uploader,
+		partSize: partSize,
+		free:     make(chan []byte, buffers),
+		dataCh:   make(chan q.PartData),
+		done:     make(chan struct{}),
+	}
+	if p.keys != nil {
+		w.closeErr = errEncryptNotSupported
+	} else if p.compressor != nil {
+		w.meta = map[string]string{metaCompress: p.compressor.Name()}
+		cw, err := p.compressor.NewWriter(partWriter{w})
+		if err != nil {
+			w.closeErr = err
+		}
+		w.cw = cw
+	}
+	return w
+}
+
+func (w *UploadWriter) Write(b []byte) (n int, err error) {
+	if w.closeErr != nil {
+		return 0, w.closeErr
+	}
+	if w.cw != nil {
+		return w.cw.Write(b)
+	}
+	return w.write(b)
+}
+
+// partWriter 把压缩后的数据写入 UploadWriter 的分片缓冲
+type partWriter struct {
+	w *UploadWriter
+}
+
+func (p partWriter) Write(b []byte) (int, error) {
+	return p.w.write(b)
+}
+
+// write 把 b 写入分片缓冲，缓冲写满时交给上传协程
+func (w *UploadWriter) write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		if w.buf == nil {
+			if w.buf, err = w.getBuf(); err != nil {
+				return
+			}
+		}
+		c := copy(w.buf[len(w.buf):cap(w.buf)], b)
+		w.buf = w.buf[:len(w.buf)+c]
+		n += c
+		b = b[c:]
+		if len(w.buf) == cap(w.buf) {
+			if err = w.flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// getBuf 取一个空闲的分片缓冲，缓冲都在上传中时等待
+func (w *UploadWriter) getBuf() ([]byte, error) {
+	select {
+	case buf := <-w.free:
+		return buf, nil
+	default:
+	}
+	if w.allocated < cap(w.free) {
+		w.allocated++
+		return make([]byte, 0, w.partSize), nil
+	}
+	select {
+	case buf := <-w.free:
+		return buf, nil
+	case <-w.done:
+		return nil, w.result()
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	}
+}
+
+func (w *UploadWriter) result() error {
+	if w.err != nil {
+		return w.err
+	}
+	return errWriterClosed
+}
+
+func (w *UploadWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	go func() {
+		defer close(w.done)
+		upToken, err := w.p.makeUptoken(w.ctx, &w.policy)
+		if err != nil {
+			w.err = err
+			return
+		}
+		t := time.Now()
+		var mp *q.CompleteMultipart
+		if w.meta != nil {
+			mp = &q.CompleteMultipart{Metadata: w.meta}
+		}
+		w.err = w.uploader.UploadWithDataChan(w.ctx, nil, upToken, w.key, w.dataCh, mp, nil, nil)
+		elog.Info("up time ", w.key, time.Now().Sub(t))
+	}()
+}
+
+// flush 把当前缓冲作为一个分片交给上传协程
+func (w *UploadWriter) flush() error {
+	w.start()
+	buf := w.buf
+	w.buf = nil
+	part := q.PartData{
+		Data: bytes.NewReader(buf),
+		Size: len(buf),
+		Finish: func() {
+			w.free <- buf[:0]
+		},
+	}
+	select {
+	case w.dataCh <- part:
+		return nil
+	case <-w.done:
+		w.free <- buf[:0]
+		return w.result()
+	}
+}
+
+// Close 上传剩余的数据并合成文件，返回上传的结果
+func (w *UploadWriter) Close() error {
+	if w.closeErr != nil {
+		return w.closeErr
+	}
+	defer w.cancel()
+	if w.cw != nil {
+		if err := w.cw.Close(); err != nil {
+			w.closeErr = errWriterClosed
+			return err
+		}
+	}
+	w.closeErr = errWriterClosed
+
+	if !w.started {
+		return w.p.putReaderAt(w.ctx, w.key, bytes.NewReader(w.buf), int64(len(w.buf)), w.meta, nil)
+	}
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	close(w.dataCh)
+	<-w.done
+	return w.err
+}
+
+// CloseWithError 放弃上传并删除已上传的分片，之后的 Write 返回 err
+func (w *UploadWriter) CloseWithError(err error) error {
+	if w.closeErr != nil {
+		return nil
+	}
+	if err == nil {
+		err = errWriterClosed
+	}
+	w.closeErr = err
+	elog.Warn("upload writer aborted", w.key, err)
+	w.cancel()
+	if w.started {
+		<-w.done
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package operation
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeAll 以不对齐分片的大小分多次写入 data
+func writeAll(t *testing.T, w *UploadWriter, data []byte) {
+	for off := 0; off < len(data); off += 7777 {
+		end := off + 7777
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err := w.Write(data[off:end])
+		assert.NoError(t, err)
+	}
+}
+
+func TestUploadWriter(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	p := NewUploader(s.config())
+
+	data := testData(5<<19 + 123)
+	w := p.NewWriter(context.Background(), "key", nil)
+	writeAll(t, w, data)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, data, s.get("key").data)
+	assert.Equal(t, []int64{1 << 20, 1 << 20, 1<<19 + 123}, s.get("key").parts)
+	assert.Empty(t, s.requestsWith("POST /put/"))
+
+	_, err := w.Write(data)
+	assert.Equal(t, errWriterClosed, err)
+	assert.Equal(t, errWriterClosed, w.Close())
+}
+
+func TestUploadWriterSmall(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	p := NewUploader(s.config())
+
+	// 不足一个分片时直接上传
+	data := testData(1000)
+	w := p.NewWriter(context.Background(), "key", nil)
+	writeAll(t, w, data)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, data, s.get("key").data)
+	assert.Len(t, s.requestsWith("POST /put/"), 1)
+	assert.Empty(t, s.requestsWith("POST /buckets/"))
+}
+
+func TestUploadWriterCloseWithError(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	p := NewUploader(s.config())
+
+	// 第一个分片已经交给上传协程，放弃上传时删除分片上传任务
+	w := p.NewWriter(context.Background(), "key", nil)
+	writeAll(t, w, testData(3<<19))
+	errAbort := errors.New("abort")
+	assert.NoError(t, w.CloseWithError(errAbort))
+	assert.Equal(t, []string{"upload-1"}, s.aborted)
+	assert.Nil(t, s.get("key"))
+
+	_, err := w.Write([]byte("more"))
+	assert.Equal(t, errAbort, err)
+	assert.Equal(t, errAbort, w.Close())
+}
+
+func TestUploadWriterCompress(t *testing.T) {
+	s := newKodoServer()
+	defer s.Close()
+	p := NewUploader(s.config())
+	assert.NoError(t, p.SetCompression("gzip"))
+	d := NewDownloader(s.config())
+
+	// 随机数据压缩后仍然超过一个分片，使用分片上传；重复的数据压缩后直接上传。两种方式都保存压缩后的内容
+	random := make([]byte, 3<<19)
+	rand.New(rand.NewSource(1)).Read(random)
+	for key, data := range map[string][]byte{"multipart": random, "small": testData(3 << 19)} {
+		w := p.NewWriter(context.Background(), key, nil)
+		writeAll(t, w, data)
+		assert.NoError(t, w.Close())
+		o := s.get(key)
+		assert.Equal(t, map[string]string{metaCompress: "gzip"}, o.meta, key)
+		assert.NotEqual(t, data, o.data, key)
+
+		b, err := d.DownloadBytes(key)
+		assert.NoError(t, err)
+		assert.Equal(t, data, b, key)
+	}
+	assert.Len(t, s.get("multipart").parts, 2)
+	assert.Empty(t, s.get("small").parts)
+	assert.Len(t, s.requestsWith("POST /put/"), 1)
+}
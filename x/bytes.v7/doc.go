@@ -29,5 +29,17 @@ NewBuffer 创建一个可随机读写的内存文件，支持 ReadAt/WriteAt 方
 	slice := make([]byte, 105)
 	n, err := b.ReadAt(slice, 0)
 	...
+
+NewPool 创建一个按大小分级、可限制总内存的缓存池，DefaultPool 是上传、下载共用的缓存池：
+
+	bytes.DefaultPool.SetLimit(512 << 20)
+	buf := bytes.DefaultPool.Get(4 << 20)
+	...
+	bytes.DefaultPool.Put(buf)
+	inUse := bytes.DefaultPool.InUse()
+
+缓冲作为 http 请求的 body 时，可以用 Pool.NewReader 包装，由 Transport 关闭 body 时归还：
+
+	req, err := http.NewRequest("PUT", url, bytes.DefaultPool.NewReader(buf))
 */
 package bytes
@@ -0,0 +1,151 @@
+package bytes
+
+import (
+	"context"
+	"sync"
+)
+
+// ---------------------------------------------------
+
+const (
+	minClassBits = 12 // 4K
+	maxClassBits = 26 // 64M
+)
+
+// Pool 是按 2 的幂分级的 []byte 缓存池。limit > 0 时借出的缓冲总大小不超过 limit，
+// 超过时 Get 等待其他缓冲归还。大于 64M 的缓冲不缓存，但同样计入借出的大小。
+type Pool struct {
+	mutex   sync.Mutex
+	limit   int64
+	inUse   int64
+	wake    chan struct{}
+	classes [maxClassBits - minClassBits + 1]sync.Pool
+}
+
+func NewPool(limit int64) *Pool {
+	return &Pool{limit: limit, wake: make(chan struct{})}
+}
+
+// 上传、下载共用的缓存池，默认不限制大小
+var DefaultPool = NewPool(0)
+
+func classOf(size int) (idx int, classSize int) {
+	if size > 1<<maxClassBits {
+		return -1, size
+	}
+	classSize = 1 << minClassBits
+	for classSize < size {
+		classSize <<= 1
+		idx++
+	}
+	return
+}
+
+func (p *Pool) SetLimit(limit int64) {
+	p.mutex.Lock()
+	p.limit = limit
+	p.notify()
+	p.mutex.Unlock()
+}
+
+func (p *Pool) Limit() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.limit
+}
+
+// 当前借出的缓冲总大小
+func (p *Pool) InUse() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.inUse
+}
+
+func (p *Pool) notify() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// Get 借用一个长度为 size 的缓冲，用完后需要调用 Put 归还。
+func (p *Pool) Get(size int) []byte {
+	b, _ := p.GetContext(context.Background(), size)
+	return b
+}
+
+// GetContext 与 Get 相同，等待其他缓冲归还时 ctx 取消则返回 ctx.Err()。
+func (p *Pool) GetContext(ctx context.Context, size int) ([]byte, error) {
+	idx, classSize := classOf(size)
+	p.mutex.Lock()
+	// 没有借出任何缓冲时总是允许，避免单个缓冲超过 limit 时永远等待
+	for p.limit > 0 && p.inUse > 0 && p.inUse+int64(classSize) > p.limit {
+		wake := p.wake
+		p.mutex.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mutex.Lock()
+	}
+	p.inUse += int64(classSize)
+	p.mutex.Unlock()
+
+	if idx >= 0 {
+		if b, ok := p.classes[idx].Get().([]byte); ok {
+			return b[:size], nil
+		}
+	}
+	return make([]byte, size, classSize), nil
+}
+
+// Put 归还 Get 借出的缓冲，不能归还其他来源的缓冲。
+func (p *Pool) Put(b []byte) {
+	if b == nil {
+		return
+	}
+	idx, classSize := classOf(cap(b))
+	if classSize != cap(b) {
+		return
+	}
+	p.mutex.Lock()
+	p.inUse -= int64(classSize)
+	p.notify()
+	p.mutex.Unlock()
+
+	if idx >= 0 {
+		p.classes[idx].Put(b[:0])
+	}
+}
+
+// ---------------------------------------------------
+
+// PoolReader 读取从 Pool 借用的缓冲，Close 时归还缓冲，之后的读取返回 io.EOF。
+// 作为 http 请求的 body 时，Transport 不再读取后才会调用 Close，可以避免请求仍在发送时缓冲被复用。
+type PoolReader struct {
+	mutex sync.Mutex
+	pool  *Pool
+	r     Reader
+}
+
+// NewReader 返回读取 b 的 PoolReader，b 必须是从 p 借用的缓冲
+func (p *Pool) NewReader(b []byte) *PoolReader {
+	return &PoolReader{pool: p, r: Reader{b: b}}
+}
+
+func (r *PoolReader) Read(val []byte) (n int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Read(val)
+}
+
+// Close 归还缓冲，可以多次调用
+func (r *PoolReader) Close() error {
+	r.mutex.Lock()
+	b := r.r.b
+	r.r = Reader{}
+	r.mutex.Unlock()
+	r.pool.Put(b)
+	return nil
+}
+
+// ---------------------------------------------------
@@ -0,0 +1,64 @@
+package bytes
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	p := NewPool(20 << 10)
+
+	b := p.Get(100)
+	assert.Equal(t, 100, len(b))
+	assert.Equal(t, 4<<10, cap(b))
+	assert.Equal(t, int64(4<<10), p.InUse())
+
+	b2 := p.Get(9 << 10)
+	assert.Equal(t, 16<<10, cap(b2))
+	assert.Equal(t, int64(20<<10), p.InUse())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := p.GetContext(ctx, 1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	done := make(chan []byte)
+	go func() {
+		done <- p.Get(1)
+	}()
+	p.Put(b2)
+	b3 := <-done
+	assert.Equal(t, int64(8<<10), p.InUse())
+
+	p.Put(b)
+	p.Put(b3)
+	assert.Equal(t, int64(0), p.InUse())
+
+	big := p.Get(100 << 20)
+	assert.Equal(t, 100<<20, len(big))
+	p.Put(big)
+	assert.Equal(t, int64(0), p.InUse())
+}
+
+func TestPoolReader(t *testing.T) {
+	p := NewPool(0)
+	b := p.Get(3)
+	copy(b, "abc")
+	r := p.NewReader(b)
+
+	buf := make([]byte, 2)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ab", string(buf[:n]))
+	assert.Equal(t, int64(4<<10), p.InUse())
+
+	assert.NoError(t, r.Close())
+	assert.NoError(t, r.Close())
+	assert.Equal(t, int64(0), p.InUse())
+	_, err = r.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}